@@ -0,0 +1,101 @@
+package postgresstore
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// readCache is a bounded, in-process LRU cache of session data, used by Find
+// when the store is created with the WithReadCache option.
+type readCache struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type cacheEntry struct {
+	token     string
+	data      []byte
+	expiresAt time.Time
+}
+
+func newReadCache(size int, ttl time.Duration) *readCache {
+	return &readCache{
+		size:  size,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// get returns the cached data for a token, if it is present and has not
+// expired.
+func (c *readCache) get(token string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[token]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if !time.Now().Before(entry.expiresAt) {
+		c.removeElement(el)
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return entry.data, true
+}
+
+// set adds data for a token to the cache. The entry is kept for the cache TTL,
+// or until the session expires if that is sooner. A zero sessionExpiry means
+// that the session never expires.
+func (c *readCache) set(token string, data []byte, sessionExpiry time.Time) {
+	expiresAt := time.Now().Add(c.ttl)
+	if !sessionExpiry.IsZero() && sessionExpiry.Before(expiresAt) {
+		expiresAt = sessionExpiry
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[token]; ok {
+		entry := el.Value.(*cacheEntry)
+		entry.data = data
+		entry.expiresAt = expiresAt
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.items[token] = c.ll.PushFront(&cacheEntry{token: token, data: data, expiresAt: expiresAt})
+	for c.ll.Len() > c.size {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+// remove evicts a token from the cache.
+func (c *readCache) remove(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[token]; ok {
+		c.removeElement(el)
+	}
+}
+
+// clear evicts every token from the cache.
+func (c *readCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+func (c *readCache) removeElement(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*cacheEntry).token)
+}
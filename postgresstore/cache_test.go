@@ -0,0 +1,65 @@
+package postgresstore
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestReadCacheEviction(t *testing.T) {
+	c := newReadCache(2, time.Minute)
+
+	c.set("session_token_1", []byte("encoded_data_1"), time.Time{})
+	c.set("session_token_2", []byte("encoded_data_2"), time.Time{})
+	c.get("session_token_1")
+	c.set("session_token_3", []byte("encoded_data_3"), time.Time{})
+
+	if _, found := c.get("session_token_2"); found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+	b, found := c.get("session_token_1")
+	if found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+	if bytes.Equal(b, []byte("encoded_data_1")) == false {
+		t.Fatalf("got %v: expected %v", b, []byte("encoded_data_1"))
+	}
+
+	c.remove("session_token_1")
+	if _, found := c.get("session_token_1"); found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+}
+
+func TestReadCacheExpiry(t *testing.T) {
+	c := newReadCache(10, time.Minute)
+
+	c.set("session_token", []byte("encoded_data"), time.Now().Add(100*time.Millisecond))
+	if _, found := c.get("session_token"); found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, found := c.get("session_token"); found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+}
+
+func TestReadCacheClear(t *testing.T) {
+	c := newReadCache(2, time.Minute)
+
+	c.set("session_token_1", []byte("encoded_data_1"), time.Time{})
+	c.set("session_token_2", []byte("encoded_data_2"), time.Time{})
+	c.clear()
+
+	for _, token := range []string{"session_token_1", "session_token_2"} {
+		if _, found := c.get(token); found != false {
+			t.Fatalf("got %v: expected %v", found, false)
+		}
+	}
+
+	c.set("session_token_3", []byte("encoded_data_3"), time.Time{})
+	if _, found := c.get("session_token_3"); found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+}
@@ -0,0 +1,514 @@
+package postgresstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	// adaptiveCleanupBusyRows is the number of rows which a cleanup run must
+	// delete for the adaptive cleanup interval to be shortened.
+	adaptiveCleanupBusyRows = 1000
+
+	// cleanupPingTimeout is how long the cleanup waits for the database to
+	// respond to a ping before each run.
+	cleanupPingTimeout = 5 * time.Second
+
+	// maxCleanupBackoff is the longest the cleanup waits between pings while
+	// the database is unreachable, unless the cleanup interval is longer.
+	maxCleanupBackoff = time.Hour
+
+	// cleanupPoolGuardRetry is how long the cleanup waits before retrying a
+	// run which was put off because the connection pool was busy, unless the
+	// cleanup interval is shorter.
+	cleanupPoolGuardRetry = 10 * time.Second
+)
+
+// CleanupStrategy selects how the cleanup deletes expired sessions, as set by
+// the WithCleanupStrategy option.
+type CleanupStrategy string
+
+const (
+	// CleanupDelete deletes expired sessions with a plain DELETE, or a DELETE
+	// of a LIMIT subquery when WithCleanupBatchSize or WithMaxCleanupRows is
+	// used. This is the default.
+	CleanupDelete CleanupStrategy = "delete"
+
+	// CleanupSkipLocked selects the expired sessions to delete with SELECT ...
+	// FOR UPDATE SKIP LOCKED, so that cleanups running concurrently in several
+	// instances each delete a disjoint set of rows without waiting for each
+	// other. It is best combined with WithCleanupBatchSize, so that each
+	// statement locks a bounded number of rows.
+	CleanupSkipLocked CleanupStrategy = "skip-locked"
+)
+
+// CleanupThrottle describes how the background cleanup goroutine adjusts a
+// run to the pressure on the connection pool it uses.
+type CleanupThrottle string
+
+const (
+	// CleanupUnthrottled means that the cleanup runs normally.
+	CleanupUnthrottled CleanupThrottle = "unthrottled"
+
+	// CleanupReduced means that the cleanup runs with the smaller batch size
+	// set with WithCleanupThrottle, because the pool pressure is above its
+	// threshold.
+	CleanupReduced CleanupThrottle = "reduced"
+
+	// CleanupDeferred means that the cleanup puts off its run, because the
+	// pool pressure is above the limit set with WithCleanupPoolGuard.
+	CleanupDeferred CleanupThrottle = "deferred"
+)
+
+// CleanupThrottleReport holds the pressure on the cleanup's connection pool
+// and the throttle it leads to, as returned by CleanupThrottleState.
+type CleanupThrottleReport struct {
+	// PoolPressure is the ratio of in-use connections to
+	// sql.DB.SetMaxOpenConns in the pool that the cleanup uses. It is zero if
+	// the pool has no limit on open connections.
+	PoolPressure float64
+
+	// Throttle is how a cleanup run starting now would be adjusted.
+	Throttle CleanupThrottle
+}
+
+// checkSchema checks that the sessions table and its expiry column exist,
+// using information_schema, so that a store whose table hasn't been created
+// yet fails when it's constructed rather than on every cleanup run. The names
+// are looked up as they were configured, before they're quoted, so unquoted
+// names are folded to lower case in the same way as PostgreSQL does.
+func checkSchema(ctx context.Context, q queryer, o *storeOptions) error {
+	name := func(s string) string {
+		if o.quoteIdentifiers {
+			return s
+		}
+		return strings.ToLower(s)
+	}
+
+	table := o.sessionTableName
+	i := strings.LastIndex(table, ".")
+	if i >= 0 {
+		table = table[i+1:]
+	}
+	args := &queryArgs{dialect: o.dialect}
+	tablePlaceholder := args.add(name(table))
+	columnPlaceholder := args.add(name(o.expiryColumnName))
+	inSchema := "table_schema = ANY (current_schemas(false))"
+	if i >= 0 {
+		inSchema = "table_schema = " + args.add(name(o.sessionTableName[:i]))
+	}
+
+	var tableExists, columnExists bool
+	err := q.QueryRowContext(ctx, fmt.Sprintf(
+		`SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE %s AND table_name = %s),
+		EXISTS (SELECT 1 FROM information_schema.columns WHERE %s AND table_name = %s AND column_name = %s)`,
+		inSchema, tablePlaceholder, inSchema, tablePlaceholder, columnPlaceholder,
+	), args.values...).Scan(&tableExists, &columnExists)
+	if err != nil {
+		return classifyError(err)
+	}
+	if !tableExists {
+		return fmt.Errorf("%w: %s", ErrTableMissing, o.sessionTableName)
+	}
+	if !columnExists {
+		return fmt.Errorf("%w: %s", ErrColumnMissing, o.expiryColumnName)
+	}
+	return nil
+}
+
+func (p *PostgresStore) startCleanup(interval time.Duration) {
+	defer p.cleanup.setRunning(false)
+
+	if p.opts.cleanupOnStart {
+		err := p.deleteExpired()
+		p.cleanup.recordRun(err)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	interval = p.nextCleanupInterval(interval, -1)
+	timer := time.NewTimer(interval)
+	var backoff time.Duration
+	for {
+		select {
+		case <-timer.C:
+			// While the connection pool is busy, the run is put off or uses
+			// smaller batches, so that request traffic gets the connections.
+			throttle := p.CleanupThrottleState().Throttle
+			if throttle == CleanupDeferred {
+				retry := cleanupPoolGuardRetry
+				if interval < retry {
+					retry = interval
+				}
+				timer.Reset(retry)
+				continue
+			}
+
+			// If the database can't be reached, the run is skipped rather than
+			// waiting for the delete to time out, and the next attempt is
+			// backed off until the database responds again.
+			if err := p.pingCleanupDB(); err != nil {
+				p.cleanup.recordRun(err)
+				log.Println(err)
+				backoff = cleanupBackoff(backoff, interval)
+				timer.Reset(backoff)
+				continue
+			}
+			backoff = 0
+
+			batchSize := p.opts.cleanupBatchSize
+			if throttle == CleanupReduced && (batchSize == 0 || batchSize > p.opts.cleanupThrottleBatchSize) {
+				batchSize = p.opts.cleanupThrottleBatchSize
+			}
+			n, err := p.deleteExpiredBatches(batchSize)
+			p.cleanup.recordRun(err)
+			if err != nil {
+				log.Println(err)
+				n = -1
+			}
+			interval = p.nextCleanupInterval(interval, n)
+			timer.Reset(interval)
+		case <-p.stopCleanup:
+			timer.Stop()
+			return
+		case <-p.cleanupContext().Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// nextCleanupInterval returns the interval to wait before the next cleanup,
+// given the current interval and the number of rows deleted by the last run,
+// or -1 if it failed. Unless WithAdaptiveCleanup is used, this is always the
+// current interval. Otherwise the interval is doubled after a run which
+// deleted nothing and halved after a busy run, within the configured bounds.
+func (p *PostgresStore) nextCleanupInterval(interval time.Duration, n int) time.Duration {
+	if p.opts.minCleanupInterval == 0 {
+		return interval
+	}
+
+	switch {
+	case n == 0:
+		interval *= 2
+	case n >= adaptiveCleanupBusyRows, p.opts.maxCleanupRows > 0 && n >= p.opts.maxCleanupRows:
+		interval /= 2
+	}
+	if interval < p.opts.minCleanupInterval {
+		interval = p.opts.minCleanupInterval
+	}
+	if interval > p.opts.maxCleanupInterval {
+		interval = p.opts.maxCleanupInterval
+	}
+	return interval
+}
+
+// cleanupBackoff returns how long to wait before the next cleanup attempt when
+// the database is unreachable, given the previous backoff, or zero if the last
+// attempt succeeded, and the cleanup interval. The backoff starts at twice the
+// interval and doubles after each failure, up to maxCleanupBackoff.
+func cleanupBackoff(backoff, interval time.Duration) time.Duration {
+	if backoff < interval {
+		backoff = interval
+	}
+	backoff *= 2
+
+	max := maxCleanupBackoff
+	if interval > max {
+		max = interval
+	}
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
+
+// CleanupThrottleState returns the pressure on the connection pool that the
+// background cleanup goroutine uses, and how it would adjust a run starting
+// now: deferring it while the pressure is above the limit set with
+// WithCleanupPoolGuard, or reducing its batch size while the pressure is above
+// the threshold set with WithCleanupThrottle. The cleanup returns to normal as
+// soon as the pressure drops. This is useful for dashboards.
+func (p *PostgresStore) CleanupThrottleState() CleanupThrottleReport {
+	report := CleanupThrottleReport{Throttle: CleanupUnthrottled}
+	if p.db == nil {
+		return report
+	}
+	stats := p.cleanupDB().Stats()
+	if stats.MaxOpenConnections == 0 {
+		return report
+	}
+	report.PoolPressure = float64(stats.InUse) / float64(stats.MaxOpenConnections)
+
+	switch {
+	case p.opts.cleanupMaxInUseRatio > 0 && report.PoolPressure > p.opts.cleanupMaxInUseRatio:
+		report.Throttle = CleanupDeferred
+	case p.opts.cleanupThrottleRatio > 0 && report.PoolPressure > p.opts.cleanupThrottleRatio:
+		report.Throttle = CleanupReduced
+	}
+	return report
+}
+
+// pingCleanupDB checks that the database used by the cleanup can be reached.
+func (p *PostgresStore) pingCleanupDB() error {
+	ctx, cancel := context.WithTimeout(p.cleanupContext(), cleanupPingTimeout)
+	defer cancel()
+	return classifyError(p.cleanupDB().PingContext(ctx))
+}
+
+// cleanupDB returns the database that cleanup queries should be run against.
+func (p *PostgresStore) cleanupDB() *sql.DB {
+	if p.opts.cleanupDB != nil {
+		return p.opts.cleanupDB
+	}
+	return p.db.get()
+}
+
+// StopCleanup terminates the background cleanup goroutine for the PostgresStore
+// instance. It's rare to terminate this; generally PostgresStore instances and
+// their cleanup goroutines are intended to be long-lived and run for the lifetime
+// of your application.
+//
+// There may be occasions though when your use of the PostgresStore is transient.
+// An example is creating a new PostgresStore instance in a test function. In this
+// scenario, the cleanup goroutine (which will run forever) will keep running
+// even after the test function has finished. You can prevent this by manually
+// calling StopCleanup, or by using the WithStopCleanupOnGC option.
+//
+// StopCleanup never blocks, and it is safe to call it more than once.
+func (p *PostgresStore) StopCleanup() {
+	if p != nil && p.stopCleanup != nil {
+		select {
+		case p.stopCleanup <- true:
+		default:
+		}
+	}
+}
+
+// DeleteExpired removes expired sessions in the same way as a run of the
+// background cleanup goroutine, including honouring WithCleanupBatchSize,
+// WithMaxCleanupRows and the deleted tokens callback, and returns the number
+// of sessions removed. Combined with WithoutCleanup, it lets an external
+// scheduler drive the cleanup of each store at its own cadence. Like the
+// background cleanup, it is not limited by WithMaxConcurrency.
+func (p *PostgresStore) DeleteExpired(ctx context.Context) (int, error) {
+	if err := p.checkDB(); err != nil {
+		return 0, err
+	}
+	defer p.observe("DeleteExpired")()
+
+	c := &PostgresStore{db: p.db, q: p.q, opts: p.opts, cleanupCtx: ctx}
+	n, err := c.deleteExpiredCount()
+	return n, classifyError(err)
+}
+
+// IterateExpired calls fn with the token and expiry time of each expired
+// session which the cleanup would delete, without deleting them, so that they
+// can be logged or archived before calling DeleteExpired. The rows are
+// streamed from the database. If fn returns an error, iteration stops and that
+// error is returned. Sessions which expire between IterateExpired and
+// DeleteExpired are deleted without being passed to fn, unless they are picked
+// up by a later IterateExpired. When tokens are stored as HMACs, fn is passed
+// the stored HMAC.
+func (p *PostgresStore) IterateExpired(ctx context.Context, fn func(token string, expiry time.Time) error) error {
+	if err := p.checkDB(); err != nil {
+		return err
+	}
+	defer p.observe("IterateExpired")()
+	release, err := p.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	rows, err := p.q.QueryContext(ctx, fmt.Sprintf(
+		"SELECT %s, %s FROM %s WHERE %s",
+		p.opts.tokenColumnName, p.opts.expiryColumnName, p.opts.sessionTableName, p.expiredPredicate(p.nowExpr()),
+	))
+	if err != nil {
+		return classifyError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		err = ctx.Err()
+		if err != nil {
+			return classifyError(err)
+		}
+
+		var (
+			token  string
+			expiry sql.NullTime
+		)
+		err = rows.Scan(&token, &expiry)
+		if err != nil {
+			return classifyError(err)
+		}
+
+		err = fn(token, expiry.Time)
+		if err != nil {
+			return err
+		}
+	}
+
+	return classifyError(rows.Err())
+}
+
+func (p *PostgresStore) deleteExpired() error {
+	_, err := p.deleteExpiredCount()
+	return err
+}
+
+// deleteExpiredCount is the same as deleteExpired, except it also returns the
+// number of sessions deleted.
+func (p *PostgresStore) deleteExpiredCount() (int, error) {
+	return p.deleteExpiredBatches(p.opts.cleanupBatchSize)
+}
+
+// deleteExpiredBatches is the same as deleteExpiredCount, except that it
+// deletes the expired sessions in batches of batchSize, or in one statement if
+// batchSize is zero, rather than using the batch size set with
+// WithCleanupBatchSize.
+func (p *PostgresStore) deleteExpiredBatches(batchSize int) (int, error) {
+	total := 0
+	for {
+		// The limit for this statement is the batch size, reduced if needed
+		// so that no more than the maximum number of rows are deleted. A limit
+		// of zero means there is no limit.
+		limit := batchSize
+		if p.opts.maxCleanupRows > 0 {
+			remaining := p.opts.maxCleanupRows - total
+			if limit == 0 || remaining < limit {
+				limit = remaining
+			}
+		}
+
+		var (
+			n        int
+			tokens   []string
+			expiries []time.Time
+		)
+		err := p.withCleanupConn(func(q queryer) error {
+			var err error
+			n, tokens, expiries, err = p.deleteExpiredBatch(q, limit)
+			return err
+		})
+		if err != nil {
+			return total, err
+		}
+		p.notifyDeleted(tokens, expiries)
+
+		total += n
+		if limit == 0 || n < limit {
+			return total, nil
+		}
+		if p.opts.maxCleanupRows > 0 && total >= p.opts.maxCleanupRows {
+			return total, nil
+		}
+	}
+}
+
+// withCleanupConn calls fn with the handle that cleanup queries should be run
+// against.
+func (p *PostgresStore) withCleanupConn(fn func(q queryer) error) error {
+	db := p.cleanupDB()
+
+	if p.opts.applicationName == "" {
+		return fn(p.wrapQueryer(db))
+	}
+
+	// The application_name setting is scoped to a transaction so that it is
+	// reset before the connection is returned to the pool.
+	tx, err := db.BeginTx(p.cleanupContext(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	q := p.wrapQueryer(tx)
+	_, err = q.ExecContext(p.cleanupContext(), "SELECT set_config('application_name', $1, true)", p.opts.applicationName)
+	if err != nil {
+		return err
+	}
+	err = fn(q)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// deleteExpiredBatch deletes up to limit expired sessions using q, or all of
+// them if limit is zero, and returns the number of sessions deleted. If a
+// deleted tokens callback, cleanup expiry hook or event sink is configured,
+// the tokens or expiry times of the deleted sessions are returned too.
+func (p *PostgresStore) deleteExpiredBatch(q queryer, limit int) (int, []string, []time.Time, error) {
+	returning := p.opts.deletedTokensCallback != nil || p.opts.cleanupExpiryHook != nil || p.opts.eventSink != nil || p.opts.largeObjectData
+	query, args := p.deleteExpiredQuery(limit, returning)
+	if !returning {
+		res, err := q.ExecContext(p.cleanupContext(), query, args...)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		n, err := res.RowsAffected()
+		return int(n), nil, nil, err
+	}
+
+	rows, err := q.QueryContext(p.cleanupContext(), query, args...)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer rows.Close()
+
+	var (
+		n        int
+		tokens   []string
+		expiries []time.Time
+	)
+	for rows.Next() {
+		var (
+			token  string
+			expiry sql.NullTime
+		)
+		err = rows.Scan(&token, &expiry)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		n++
+		if p.opts.deletedTokensCallback != nil || p.opts.eventSink != nil {
+			tokens = append(tokens, token)
+		}
+		if p.opts.cleanupExpiryHook != nil {
+			expiries = append(expiries, expiry.Time)
+		}
+	}
+	return n, tokens, expiries, rows.Err()
+}
+
+// notifyDeleted passes the tokens and expiry times of the sessions removed by
+// a cleanup to the deleted tokens callback, cleanup expiry hook and event
+// sink, if they are configured.
+func (p *PostgresStore) notifyDeleted(tokens []string, expiries []time.Time) {
+	if p.opts.eventSink != nil {
+		for _, token := range tokens {
+			p.publish(SessionExpired, token, time.Time{})
+		}
+	}
+	if p.opts.deletedTokensCallback != nil && len(tokens) > 0 {
+		p.opts.deletedTokensCallback(tokens)
+	}
+	if p.opts.cleanupExpiryHook != nil && len(expiries) > 0 {
+		p.opts.cleanupExpiryHook(expiries)
+	}
+}
+
+// cleanupContext returns the context that cleanup queries should be run with.
+func (p *PostgresStore) cleanupContext() context.Context {
+	if p.cleanupCtx == nil {
+		return context.Background()
+	}
+	return p.cleanupCtx
+}
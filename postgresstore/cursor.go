@@ -0,0 +1,66 @@
+package postgresstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// Cursor iterates over the active sessions in a PostgresStore in batches
+// ordered by token, as returned by NewCursor. Each batch is read with its own
+// query, so no connection is held between calls to Next, and iteration can be
+// paused for as long as needed. Sessions inserted or deleted during the
+// iteration may or may not be included. A Cursor must not be used
+// concurrently.
+type Cursor struct {
+	p         *PostgresStore
+	batchSize int
+	lastToken *string
+	done      bool
+}
+
+// NewCursor returns a Cursor which reads up to batchSize sessions on each call
+// to Next, starting from the first token.
+func (p *PostgresStore) NewCursor(batchSize int) *Cursor {
+	return &Cursor{p: p, batchSize: batchSize}
+}
+
+// Seek positions the cursor so that the next batch starts after token. It can
+// be used to resume an iteration from the Token of the last session returned
+// by an earlier cursor. When tokens are stored as HMACs, the Token of each
+// session returned by Next is the stored HMAC, which is what Seek expects.
+func (c *Cursor) Seek(token string) {
+	c.lastToken = &token
+	c.done = false
+}
+
+// Next returns the next batch of sessions, with their tokens set. When there
+// are no more sessions, it returns io.EOF.
+func (c *Cursor) Next(ctx context.Context) ([]SessionInfo, error) {
+	if err := c.p.checkDB(); err != nil {
+		return nil, err
+	}
+	if c.batchSize <= 0 {
+		return nil, fmt.Errorf("postgresstore: invalid batch size %d", c.batchSize)
+	}
+	if c.done {
+		return nil, io.EOF
+	}
+	defer c.p.observe("Cursor.Next")()
+
+	sessions := make([]SessionInfo, 0, c.batchSize)
+	n, err := c.p.allBatch(ctx, c.lastToken, c.batchSize, func(info SessionInfo) {
+		sessions = append(sessions, info)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if n < c.batchSize {
+		c.done = true
+	}
+	if n == 0 {
+		return nil, io.EOF
+	}
+	c.lastToken = &sessions[n-1].Token
+	return sessions, nil
+}
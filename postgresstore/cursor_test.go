@@ -0,0 +1,80 @@
+package postgresstore
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestCursor(t *testing.T) {
+	dsn := os.Getenv("SCS_POSTGRES_TEST_DSN")
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("TRUNCATE TABLE sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO sessions SELECT 'session_token_' || i, 'encoded_data', current_timestamp + interval '1 minute' FROM generate_series(1, 5) AS i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO sessions VALUES('session_token_0', 'encoded_data', current_timestamp - interval '1 minute')")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewWithCleanupInterval(db, 0)
+
+	readAll := func(c *Cursor) [][]string {
+		var batches [][]string
+		for {
+			sessions, err := c.Next(context.Background())
+			if err == io.EOF {
+				return batches
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var tokens []string
+			for _, session := range sessions {
+				if session.Expiry.IsZero() {
+					t.Fatalf("got %v: expected an expiry time", session.Expiry)
+				}
+				tokens = append(tokens, session.Token)
+			}
+			batches = append(batches, tokens)
+		}
+	}
+
+	batches := readAll(p.NewCursor(2))
+	expected := [][]string{
+		{"session_token_1", "session_token_2"},
+		{"session_token_3", "session_token_4"},
+		{"session_token_5"},
+	}
+	if reflect.DeepEqual(batches, expected) == false {
+		t.Fatalf("got %v: expected %v", batches, expected)
+	}
+
+	c := p.NewCursor(2)
+	c.Seek("session_token_3")
+	batches = readAll(c)
+	expected = [][]string{{"session_token_4", "session_token_5"}}
+	if reflect.DeepEqual(batches, expected) == false {
+		t.Fatalf("got %v: expected %v", batches, expected)
+	}
+
+	_, err = p.NewCursor(0).Next(context.Background())
+	if err == nil {
+		t.Fatalf("got %v: expected an error", err)
+	}
+}
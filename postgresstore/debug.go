@@ -0,0 +1,103 @@
+package postgresstore
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+// debugQueryer logs the text of each query before running it against q. The
+// query arguments are never logged, as they include session tokens and data.
+type debugQueryer struct {
+	q      queryer
+	logger *log.Logger
+}
+
+func (d debugQueryer) log(query string, args []interface{}) {
+	d.logger.Printf("postgresstore: %s [%d args]", query, len(args))
+}
+
+func (d debugQueryer) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	d.log(query, args)
+	return d.q.ExecContext(ctx, query, args...)
+}
+
+func (d debugQueryer) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	d.log(query, args)
+	return d.q.QueryContext(ctx, query, args...)
+}
+
+func (d debugQueryer) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	d.log(query, args)
+	return d.q.QueryRowContext(ctx, query, args...)
+}
+
+// commentQueryer prepends a fixed comment to each query before running it
+// against q.
+type commentQueryer struct {
+	q       queryer
+	comment string
+}
+
+func (c commentQueryer) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return c.q.ExecContext(ctx, c.comment+query, args...)
+}
+
+func (c commentQueryer) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return c.q.QueryContext(ctx, c.comment+query, args...)
+}
+
+func (c commentQueryer) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return c.q.QueryRowContext(ctx, c.comment+query, args...)
+}
+
+// moduleVersion returns the version of this package recorded in the build
+// information of the running binary, or "(devel)" if it isn't known.
+func moduleVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "(devel)"
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == modulePath && dep.Version != "" {
+			return dep.Version
+		}
+	}
+	if info.Main.Path == modulePath && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+// modulePath is the module path of this package.
+const modulePath = "github.com/alexedwards/scs/postgresstore"
+
+// wrapQueryer returns q wrapped with SQL debug logging and the version comment,
+// if they are enabled. The comment is added outside the logging, so that it is
+// included in the logged queries.
+func (p *PostgresStore) wrapQueryer(q queryer) queryer {
+	if p.opts.sqlDebugLogger != nil {
+		q = debugQueryer{q: q, logger: p.opts.sqlDebugLogger}
+	}
+	if p.opts.queryComment != "" {
+		q = commentQueryer{q: q, comment: p.opts.queryComment}
+	}
+	return q
+}
+
+// observe starts timing the operation op, and returns a function which calls
+// the slow query handler when the operation has taken longer than the
+// threshold set with WithSlowQueryThreshold.
+func (p *PostgresStore) observe(op string) func() {
+	if p.opts.slowQueryHandler == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		if d := time.Since(start); d > p.opts.slowQueryThreshold {
+			p.opts.slowQueryHandler(op, d)
+		}
+	}
+}
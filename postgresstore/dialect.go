@@ -0,0 +1,73 @@
+package postgresstore
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Dialect controls the parts of the SQL generated for the core store
+// operations (Find, Commit, Delete, All and the cleanup) which differ between
+// databases. It exists so that tests can run the store against a lightweight
+// database such as SQLite; other methods only support PostgreSQL.
+type Dialect interface {
+	// Placeholder returns the placeholder for the nth bind parameter in a
+	// query, counting from 1.
+	Placeholder(n int) string
+
+	// UpsertClause returns the clause appended to an INSERT statement so that,
+	// if a row with the same value in conflictColumn already exists, the
+	// updateColumns of that row are set to the inserted values instead.
+	UpsertClause(conflictColumn string, updateColumns []string) string
+}
+
+// PostgresDialect is the default Dialect, which generates SQL for PostgreSQL.
+type PostgresDialect struct{}
+
+// Placeholder returns a numbered placeholder such as $1.
+func (PostgresDialect) Placeholder(n int) string {
+	return fmt.Sprintf("$%d", n)
+}
+
+// UpsertClause returns an ON CONFLICT ... DO UPDATE clause.
+func (PostgresDialect) UpsertClause(conflictColumn string, updateColumns []string) string {
+	return onConflictClause(conflictColumn, updateColumns)
+}
+
+// SQLiteDialect generates SQL for SQLite 3.24 or later.
+type SQLiteDialect struct{}
+
+// Placeholder returns a ? placeholder.
+func (SQLiteDialect) Placeholder(n int) string {
+	return "?"
+}
+
+// UpsertClause returns an ON CONFLICT ... DO UPDATE clause.
+func (SQLiteDialect) UpsertClause(conflictColumn string, updateColumns []string) string {
+	return onConflictClause(conflictColumn, updateColumns)
+}
+
+// MySQLDialect generates SQL for MySQL.
+type MySQLDialect struct{}
+
+// Placeholder returns a ? placeholder.
+func (MySQLDialect) Placeholder(n int) string {
+	return "?"
+}
+
+// UpsertClause returns an ON DUPLICATE KEY UPDATE clause. MySQL relies on the
+// table's unique keys to detect conflicts, so conflictColumn is not used.
+func (MySQLDialect) UpsertClause(conflictColumn string, updateColumns []string) string {
+	updates := make([]string, len(updateColumns))
+	for i, column := range updateColumns {
+		updates[i] = fmt.Sprintf("%s = VALUES(%s)", column, column)
+	}
+	return "ON DUPLICATE KEY UPDATE " + strings.Join(updates, ", ")
+}
+
+func onConflictClause(conflictColumn string, updateColumns []string) string {
+	updates := make([]string, len(updateColumns))
+	for i, column := range updateColumns {
+		updates[i] = fmt.Sprintf("%s = EXCLUDED.%s", column, column)
+	}
+	return fmt.Sprintf("ON CONFLICT (%s) DO UPDATE SET %s", conflictColumn, strings.Join(updates, ", "))
+}
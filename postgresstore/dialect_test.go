@@ -0,0 +1,28 @@
+package postgresstore
+
+import (
+	"testing"
+)
+
+func TestDialects(t *testing.T) {
+	tests := []struct {
+		dialect     Dialect
+		placeholder string
+		upsert      string
+	}{
+		{PostgresDialect{}, "$2", "ON CONFLICT (token) DO UPDATE SET data = EXCLUDED.data, expiry = EXCLUDED.expiry"},
+		{SQLiteDialect{}, "?", "ON CONFLICT (token) DO UPDATE SET data = EXCLUDED.data, expiry = EXCLUDED.expiry"},
+		{MySQLDialect{}, "?", "ON DUPLICATE KEY UPDATE data = VALUES(data), expiry = VALUES(expiry)"},
+	}
+
+	for _, tt := range tests {
+		placeholder := tt.dialect.Placeholder(2)
+		if placeholder != tt.placeholder {
+			t.Fatalf("got %q: expected %q", placeholder, tt.placeholder)
+		}
+		upsert := tt.dialect.UpsertClause("token", []string{"data", "expiry"})
+		if upsert != tt.upsert {
+			t.Fatalf("got %q: expected %q", upsert, tt.upsert)
+		}
+	}
+}
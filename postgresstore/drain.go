@@ -0,0 +1,61 @@
+package postgresstore
+
+import (
+	"context"
+	"log"
+)
+
+// Drain puts the store into drain mode, in which the methods that write to the
+// sessions table, such as Commit, Delete and Touch, return ErrDraining
+// immediately without querying the database, while Find, All and the other
+// read methods continue to work. FindTouching returns the session data
+// without extending its expiry. This allows writes to be quiesced for a
+// controlled failover or migration. The background cleanup is not affected.
+//
+// If the store was created with the WithWriteBehind option, Drain writes the
+// buffered sessions to the database before returning, logging any error, and
+// the background flusher stops writing until Undrain is called. Close still
+// writes any sessions buffered since.
+//
+// The mode applies to the store it's called on, not to views of it returned
+// by ReadTx or BindConn. It is safe to call Drain and Undrain concurrently
+// with other methods, and more than once.
+func (p *PostgresStore) Drain() {
+	p.setDraining(true)
+	if p.writes != nil {
+		p.writes.pause(true)
+		if err := p.writes.flush(context.Background(), p); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Undrain takes the store out of drain mode, so that writes are accepted
+// again.
+func (p *PostgresStore) Undrain() {
+	p.setDraining(false)
+	if p.writes != nil {
+		p.writes.pause(false)
+	}
+}
+
+// Draining reports whether the store is in drain mode.
+func (p *PostgresStore) Draining() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.draining
+}
+
+func (p *PostgresStore) setDraining(draining bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.draining = draining
+}
+
+// checkWritable returns ErrDraining if the store is in drain mode.
+func (p *PostgresStore) checkWritable() error {
+	if p.Draining() {
+		return ErrDraining
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package postgresstore
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/lib/pq"
+)
+
+// Errors returned by the PostgresStore methods can be compared against these
+// values using errors.Is to find the class of failure, without needing to
+// inspect driver-specific error codes. The original driver error remains
+// available through errors.As.
+var (
+	// ErrNilDB is returned by NewStore when it is passed a nil *sql.DB, and by
+	// the PostgresStore methods when they are called on a store which has no
+	// database handle.
+	ErrNilDB = errors.New("postgresstore: db is nil")
+
+	// ErrConnection is returned when the database could not be reached or the
+	// connection to it failed.
+	ErrConnection = errors.New("postgresstore: connection failed")
+
+	// ErrTableMissing is returned when the sessions table does not exist.
+	ErrTableMissing = errors.New("postgresstore: table does not exist")
+
+	// ErrColumnMissing is returned when one of the configured columns does not
+	// exist in the sessions table.
+	ErrColumnMissing = errors.New("postgresstore: column does not exist")
+
+	// ErrConflict is returned when an operation violates a constraint on the
+	// sessions table.
+	ErrConflict = errors.New("postgresstore: constraint violation")
+
+	// ErrCanceled is returned when an operation is cancelled, either because
+	// its context was cancelled or its deadline was exceeded, or because the
+	// query was cancelled on the server.
+	ErrCanceled = errors.New("postgresstore: operation cancelled")
+
+	// ErrNotFound is returned by methods which update an existing session when
+	// the session doesn't exist or has expired.
+	ErrNotFound = errors.New("postgresstore: session not found")
+
+	// ErrNotConfigured is returned when a method is called which requires an
+	// option that the store was not created with.
+	ErrNotConfigured = errors.New("postgresstore: required option not configured")
+
+	// ErrTooManyOperations is returned when the limit set by
+	// WithMaxConcurrency has been reached and the store was created with
+	// WithFailFast.
+	ErrTooManyOperations = errors.New("postgresstore: too many concurrent operations")
+
+	// ErrVersionConflict is returned by CommitVersioned when the stored
+	// version of the session doesn't match the expected version.
+	ErrVersionConflict = errors.New("postgresstore: session version conflict")
+
+	// ErrExpiryInPast is returned when a session is committed with an expiry
+	// time which isn't in the future, and the store was created with the
+	// WithRejectPastExpiry option.
+	ErrExpiryInPast = errors.New("postgresstore: expiry time is in the past")
+
+	// ErrDraining is returned by the methods which write to the sessions
+	// table while the store is in drain mode. See Drain.
+	ErrDraining = errors.New("postgresstore: store is draining")
+
+	// ErrSerializationFailure is returned when a transaction was rolled back
+	// by the database because it could not be serialized with concurrent
+	// transactions, or because it was chosen as the victim of a deadlock. The
+	// operation can safely be retried.
+	ErrSerializationFailure = errors.New("postgresstore: serialization failure")
+
+	// ErrTooManyRows is returned by All and its variants when there are more
+	// active sessions than the limit set with WithAllRowLimit.
+	ErrTooManyRows = errors.New("postgresstore: too many rows")
+)
+
+// notConfigured returns an ErrNotConfigured error naming the missing option.
+func notConfigured(option string) error {
+	return fmt.Errorf("%w: %s", ErrNotConfigured, option)
+}
+
+// storeError wraps an underlying error with one of the exported error classes.
+type storeError struct {
+	class error
+	err   error
+}
+
+func (e *storeError) Error() string {
+	return e.class.Error() + ": " + e.err.Error()
+}
+
+func (e *storeError) Unwrap() error {
+	return e.err
+}
+
+func (e *storeError) Is(target error) bool {
+	return target == e.class
+}
+
+// classifyError wraps err with the matching exported error class, if there is
+// one. Errors which don't match a class are returned unchanged.
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var se *storeError
+	if errors.As(err, &se) {
+		return err
+	}
+
+	var class error
+	var pqErr *pq.Error
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		class = ErrCanceled
+	case isConnectionError(err):
+		class = ErrConnection
+	case errors.As(err, &pqErr):
+		switch {
+		case pqErr.Code == "42P01":
+			class = ErrTableMissing
+		case pqErr.Code == "42703":
+			class = ErrColumnMissing
+		case pqErr.Code == "57014":
+			class = ErrCanceled
+		case pqErr.Code == "40001", pqErr.Code == "40P01":
+			class = ErrSerializationFailure
+		case pqErr.Code.Class() == "23":
+			class = ErrConflict
+		}
+	}
+
+	if class == nil {
+		return err
+	}
+	return &storeError{class: class, err: err}
+}
+
+// isConnectionError reports whether err indicates that the database could
+// not be reached, as opposed to a logical error such as a missing table.
+func isConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "57P01", "57P02", "57P03":
+			return true
+		}
+		return pqErr.Code.Class() == "08"
+	}
+	return false
+}
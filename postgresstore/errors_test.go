@@ -0,0 +1,42 @@
+package postgresstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected error
+	}{
+		{&pq.Error{Code: "42P01"}, ErrTableMissing},
+		{&pq.Error{Code: "42703"}, ErrColumnMissing},
+		{&pq.Error{Code: "23505"}, ErrConflict},
+		{&pq.Error{Code: "08006"}, ErrConnection},
+		{&pq.Error{Code: "57014"}, ErrCanceled},
+		{&pq.Error{Code: "40001"}, ErrSerializationFailure},
+		{&pq.Error{Code: "40P01"}, ErrSerializationFailure},
+		{fmt.Errorf("query: %w", context.Canceled), ErrCanceled},
+		{context.DeadlineExceeded, ErrCanceled},
+	}
+
+	for _, tt := range tests {
+		err := classifyError(tt.err)
+		if errors.Is(err, tt.expected) == false {
+			t.Fatalf("got %v: expected %v", err, tt.expected)
+		}
+		if errors.Is(err, tt.err) == false {
+			t.Fatalf("got %v: expected to wrap %v", err, tt.err)
+		}
+	}
+
+	err := errors.New("other error")
+	if classifyError(err) != err {
+		t.Fatalf("got %v: expected %v", classifyError(err), err)
+	}
+}
@@ -0,0 +1,58 @@
+package postgresstore
+
+import "time"
+
+// EventType identifies the kind of change described by a SessionEvent.
+type EventType string
+
+// The types of SessionEvent published to an EventSink.
+const (
+	// SessionCreated is published when Commit writes a session which didn't
+	// exist before.
+	SessionCreated EventType = "created"
+
+	// SessionRefreshed is published when Commit overwrites an existing
+	// session.
+	SessionRefreshed EventType = "refreshed"
+
+	// SessionDeleted is published when a session is deleted with Delete.
+	SessionDeleted EventType = "deleted"
+
+	// SessionExpired is published for each expired session removed by the
+	// cleanup.
+	SessionExpired EventType = "expired"
+)
+
+// SessionEvent describes a change to a session, as published to an EventSink.
+type SessionEvent struct {
+	Type EventType
+
+	// Token is the session token. For SessionExpired events from a store
+	// created with the WithTokenHMAC option, it is the stored HMAC.
+	Token string
+
+	// Expiry is the expiry time of the session, for SessionCreated and
+	// SessionRefreshed events. A zero Expiry means that the session never
+	// expires.
+	Expiry time.Time
+
+	// Time is when the change was made.
+	Time time.Time
+}
+
+// EventSink receives the session lifecycle events published by a
+// PostgresStore created with the WithEventSink option.
+type EventSink interface {
+	// Publish is called after the change described by event has been made in
+	// the database. It is called synchronously, so it should hand the event
+	// off rather than block, and it has no way to fail the store operation.
+	Publish(event SessionEvent)
+}
+
+// publish sends an event to the event sink, if one is configured.
+func (p *PostgresStore) publish(typ EventType, token string, expiry time.Time) {
+	if p.opts.eventSink == nil {
+		return
+	}
+	p.opts.eventSink.Publish(SessionEvent{Type: typ, Token: token, Expiry: expiry, Time: time.Now()})
+}
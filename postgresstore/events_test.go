@@ -0,0 +1,76 @@
+package postgresstore
+
+import (
+	"database/sql"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type recordingSink struct {
+	events []SessionEvent
+}
+
+func (s *recordingSink) Publish(event SessionEvent) {
+	s.events = append(s.events, event)
+}
+
+func TestEventSink(t *testing.T) {
+	dsn := os.Getenv("SCS_POSTGRES_TEST_DSN")
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("TRUNCATE TABLE sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO sessions VALUES('session_token_2', 'encoded_data_2', current_timestamp - interval '1 minute')")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink := &recordingSink{}
+	p := New(db, WithCleanupInterval(0), WithEventSink(sink))
+
+	expiry := time.Now().Add(time.Minute)
+	err = p.Commit("session_token_1", []byte("encoded_data_1"), expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Commit("session_token_1", []byte("encoded_data_1"), expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Delete("session_token_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.deleteExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var received []SessionEvent
+	for _, event := range sink.events {
+		if event.Time.IsZero() {
+			t.Fatalf("got %v: expected the event time to be set", event.Time)
+		}
+		event.Time = time.Time{}
+		received = append(received, event)
+	}
+	expected := []SessionEvent{
+		{Type: SessionCreated, Token: "session_token_1", Expiry: expiry},
+		{Type: SessionRefreshed, Token: "session_token_1", Expiry: expiry},
+		{Type: SessionDeleted, Token: "session_token_1"},
+		{Type: SessionExpired, Token: "session_token_2"},
+	}
+	if reflect.DeepEqual(received, expected) == false {
+		t.Fatalf("got %v: expected %v", received, expected)
+	}
+}
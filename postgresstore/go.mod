@@ -1,5 +1,5 @@
 module github.com/alexedwards/scs/postgresstore
 
-go 1.12
+go 1.14
 
 require github.com/lib/pq v1.4.0
@@ -0,0 +1,75 @@
+package postgresstore
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// HealthReport summarizes the health of a PostgresStore, as returned by Health.
+type HealthReport struct {
+	// Reachable reports whether the database responded to a ping.
+	Reachable bool
+
+	// Pool holds the statistics of the database connection pool.
+	Pool sql.DBStats
+
+	// CleanupRunning reports whether the background cleanup goroutine is
+	// running.
+	CleanupRunning bool
+
+	// LastCleanup is the time that the last cleanup run finished, or the zero
+	// time if there hasn't been one yet, and LastCleanupError is the error it
+	// returned, if any.
+	LastCleanup      time.Time
+	LastCleanupError error
+}
+
+// cleanupStatus records the state of the background cleanup goroutine, for
+// reporting by Health.
+type cleanupStatus struct {
+	mu      sync.Mutex
+	running bool
+	lastRun time.Time
+	lastErr error
+}
+
+func (s *cleanupStatus) setRunning(running bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = running
+}
+
+func (s *cleanupStatus) recordRun(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastRun = time.Now()
+	s.lastErr = err
+}
+
+// Health pings the database and returns a report on the state of the store,
+// including the connection pool statistics and the status of the background
+// cleanup goroutine. If the ping fails, the report is still returned, along
+// with the error.
+func (p *PostgresStore) Health(ctx context.Context) (HealthReport, error) {
+	if err := p.checkDB(); err != nil {
+		return HealthReport{}, err
+	}
+
+	var report HealthReport
+	db := p.db.get()
+	err := db.PingContext(ctx)
+	report.Reachable = err == nil
+	report.Pool = db.Stats()
+
+	if p.cleanup != nil {
+		p.cleanup.mu.Lock()
+		report.CleanupRunning = p.cleanup.running
+		report.LastCleanup = p.cleanup.lastRun
+		report.LastCleanupError = p.cleanup.lastErr
+		p.cleanup.mu.Unlock()
+	}
+
+	return report, classifyError(err)
+}
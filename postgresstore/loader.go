@@ -0,0 +1,92 @@
+package postgresstore
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// defaultLoaderWait is how long a Loader collects Load calls before issuing a
+// single FindManyWithExpiry query for them.
+const defaultLoaderWait = time.Millisecond
+
+// Loader batches concurrent Load calls into a single FindManyWithExpiry query,
+// in the style of a dataloader. A Loader is intended to be short-lived and
+// scoped to a single request, for example by creating one per HTTP request and
+// storing it in the request context.
+type Loader struct {
+	store *PostgresStore
+	wait  time.Duration
+
+	mu    sync.Mutex
+	batch *loaderBatch
+}
+
+type loaderBatch struct {
+	tokens  []string
+	seen    map[string]bool
+	done    chan struct{}
+	results map[string]SessionInfo
+	err     error
+}
+
+// NewLoader returns a new Loader which reads sessions from the given store.
+func NewLoader(store *PostgresStore) *Loader {
+	return &Loader{
+		store: store,
+		wait:  defaultLoaderWait,
+	}
+}
+
+// Load returns the data for a given session token. Calls to Load which are
+// made within a short window of each other are resolved by one query. If the
+// session token is not found or is expired, the returned exists flag will be
+// set to false. If ctx is cancelled before the batch completes, ctx.Err() is
+// returned.
+func (l *Loader) Load(ctx context.Context, token string) (b []byte, exists bool, err error) {
+	info, exists, err := l.LoadWithExpiry(ctx, token)
+	return info.Data, exists, err
+}
+
+// LoadWithExpiry is the same as Load, except that it also returns the expiry
+// time of the session.
+func (l *Loader) LoadWithExpiry(ctx context.Context, token string) (info SessionInfo, exists bool, err error) {
+	l.mu.Lock()
+	batch := l.batch
+	if batch == nil {
+		batch = &loaderBatch{
+			seen: make(map[string]bool),
+			done: make(chan struct{}),
+		}
+		l.batch = batch
+		time.AfterFunc(l.wait, func() { l.dispatch(batch) })
+	}
+	if !batch.seen[token] {
+		batch.seen[token] = true
+		batch.tokens = append(batch.tokens, token)
+	}
+	l.mu.Unlock()
+
+	select {
+	case <-batch.done:
+	case <-ctx.Done():
+		return SessionInfo{}, false, ctx.Err()
+	}
+
+	if batch.err != nil {
+		return SessionInfo{}, false, batch.err
+	}
+	info, exists = batch.results[token]
+	return info, exists, nil
+}
+
+func (l *Loader) dispatch(batch *loaderBatch) {
+	l.mu.Lock()
+	if l.batch == batch {
+		l.batch = nil
+	}
+	l.mu.Unlock()
+
+	batch.results, batch.err = l.store.FindManyWithExpiry(batch.tokens)
+	close(batch.done)
+}
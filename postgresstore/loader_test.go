@@ -0,0 +1,67 @@
+package postgresstore
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestLoader(t *testing.T) {
+	dsn := os.Getenv("SCS_POSTGRES_TEST_DSN")
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("TRUNCATE TABLE sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO sessions VALUES('session_token_1', 'encoded_data_1', current_timestamp + interval '1 minute')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO sessions VALUES('session_token_2', 'encoded_data_2', current_timestamp + interval '1 minute')")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewWithCleanupInterval(db, 0)
+	l := NewLoader(p)
+
+	tokens := []string{"session_token_1", "session_token_2", "missing_session_token"}
+	results := make([][]byte, len(tokens))
+	found := make([]bool, len(tokens))
+	errs := make([]error, len(tokens))
+
+	var wg sync.WaitGroup
+	for i, token := range tokens {
+		wg.Add(1)
+		go func(i int, token string) {
+			defer wg.Done()
+			results[i], found[i], errs[i] = l.Load(context.Background(), token)
+		}(i, token)
+	}
+	wg.Wait()
+
+	for i := range tokens {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+	}
+	if found[0] != true || found[1] != true || found[2] != false {
+		t.Fatalf("got %v: expected %v", found, []bool{true, true, false})
+	}
+	if bytes.Equal(results[0], []byte("encoded_data_1")) == false {
+		t.Fatalf("got %v: expected %v", results[0], []byte("encoded_data_1"))
+	}
+	if bytes.Equal(results[1], []byte("encoded_data_2")) == false {
+		t.Fatalf("got %v: expected %v", results[1], []byte("encoded_data_2"))
+	}
+}
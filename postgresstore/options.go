@@ -1,19 +1,257 @@
 package postgresstore
 
 import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
 	"time"
+
+	"github.com/lib/pq"
 )
 
 type storeOptions struct {
-	sessionTableName string
-	dataColumnName   string
-	tokenColumnName  string
-	expiryColumnName string
-	cleanupInterval  time.Duration
+	sessionTableName         string
+	dataColumnName           string
+	tokenColumnName          string
+	expiryColumnName         string
+	cleanupInterval          time.Duration
+	minCleanupInterval       time.Duration
+	maxCleanupInterval       time.Duration
+	fallbackStore            Store
+	applicationName          string
+	conditionalUpdate        bool
+	expiryOnlyUpdates        bool
+	isolationLevel           sql.IsolationLevel
+	isolationRetries         int
+	rejectPastExpiry         bool
+	expiryGraceWindow        time.Duration
+	readCacheSize            int
+	readCacheTTL             time.Duration
+	allRowLimit              int
+	cleanupOnStart           bool
+	stopCleanupOnGC          bool
+	deletedTokensCallback    func(tokens []string)
+	cleanupExpiryHook        func(expiries []time.Time)
+	cleanupBatchSize         int
+	maxCleanupRows           int
+	cleanupMaxInUseRatio     float64
+	cleanupThrottleRatio     float64
+	cleanupThrottleBatchSize int
+	cleanupStrategy          CleanupStrategy
+	updatedAtColumnName      string
+	updatedAtOnChange        bool
+	createdAtColumnName      string
+	deletedAtColumnName      string
+	cleanupDB                *sql.DB
+	jsonb                    bool
+	mergeOnConflict          bool
+	dialect                  Dialect
+	subjectColumnName        string
+	lookupColumnName         string
+	sessionType              string
+	typeColumnName           string
+	schemaCheck              bool
+	claimColumnName          string
+	subjectFunc              func(token string, data []byte) string
+	activePredicate          func(now string) string
+	cleanupPartitionFilter   func(now string) string
+	sqlDebugLogger           *log.Logger
+	queryComment             string
+	absoluteExpiryColumnName string
+	absoluteLifetime         time.Duration
+	tokenHMACKey             []byte
+	tokenBinder              func(token string) interface{}
+	singleFlight             bool
+	tokenLength              int
+	slowQueryThreshold       time.Duration
+	slowQueryHandler         func(op string, d time.Duration)
+	largeObjectData          bool
+	versionColumnName        string
+	quoteIdentifiers         bool
+	nowFunc                  func() time.Time
+	eventSink                EventSink
+	writeBehindInterval      time.Duration
+	writeBehindBatch         int
+	maxConcurrency           int
+	failFast                 bool
 }
 
 type StoreOption func(*storeOptions)
 
+func (o *storeOptions) validate() error {
+	if o.sessionTableName == "" {
+		return errors.New("postgresstore: session table name must not be empty")
+	}
+	if o.tokenColumnName == "" {
+		return errors.New("postgresstore: token column name must not be empty")
+	}
+	if o.dataColumnName == "" {
+		return errors.New("postgresstore: data column name must not be empty")
+	}
+	if o.expiryColumnName == "" {
+		return errors.New("postgresstore: expiry column name must not be empty")
+	}
+	if o.sessionType != "" && o.typeColumnName == "" {
+		return errors.New("postgresstore: type column name must not be empty")
+	}
+	if o.dialect == nil {
+		return errors.New("postgresstore: dialect must not be nil")
+	}
+	if o.tokenHMACKey != nil && len(o.tokenHMACKey) == 0 {
+		return errors.New("postgresstore: token HMAC key must not be empty")
+	}
+	if o.largeObjectData && (o.jsonb || o.conditionalUpdate || o.absoluteExpiryColumnName != "" || o.versionColumnName != "") {
+		return errors.New("postgresstore: large object data cannot be used with WithJSONB, WithConditionalUpdate, WithAbsoluteExpiry or WithVersionColumnName")
+	}
+	if o.largeObjectData && o.expiryOnlyUpdates {
+		return errors.New("postgresstore: expiry-only updates cannot be used with WithLargeObjectData")
+	}
+	if o.mergeOnConflict && (!o.jsonb || o.writeBehindInterval > 0) {
+		return errors.New("postgresstore: merge on conflict requires WithJSONB and cannot be used with WithWriteBehind")
+	}
+	if o.isolationRetries < 0 {
+		return errors.New("postgresstore: isolation level retries must not be negative")
+	}
+	if o.largeObjectData && o.isolationLevel != sql.LevelDefault {
+		return errors.New("postgresstore: an isolation level cannot be used with WithLargeObjectData")
+	}
+	adaptive := o.minCleanupInterval != 0 || o.maxCleanupInterval != 0
+	if adaptive && (o.minCleanupInterval <= 0 || o.maxCleanupInterval < o.minCleanupInterval) {
+		return errors.New("postgresstore: adaptive cleanup intervals must satisfy 0 < min <= max")
+	}
+	if o.writeBehindInterval < 0 || o.writeBehindBatch < 0 || (o.writeBehindInterval > 0) != (o.writeBehindBatch > 0) {
+		return errors.New("postgresstore: write-behind flush interval and batch size must both be positive")
+	}
+	if o.writeBehindInterval > 0 && o.largeObjectData {
+		return errors.New("postgresstore: write-behind cannot be used with WithLargeObjectData")
+	}
+	if o.tokenLength < 0 {
+		return errors.New("postgresstore: token length must not be negative")
+	}
+	if o.maxConcurrency < 0 {
+		return errors.New("postgresstore: maximum concurrency must not be negative")
+	}
+	if o.readCacheSize < 0 || (o.readCacheSize > 0 && o.readCacheTTL <= 0) {
+		return errors.New("postgresstore: read cache size must not be negative and its TTL must be positive")
+	}
+	if o.updatedAtOnChange && (o.updatedAtColumnName == "" || o.largeObjectData) {
+		return errors.New("postgresstore: updated-at on change requires WithUpdatedAtColumnName and cannot be used with WithLargeObjectData")
+	}
+	if o.allRowLimit < 0 {
+		return errors.New("postgresstore: all row limit must not be negative")
+	}
+	if o.cleanupBatchSize < 0 {
+		return errors.New("postgresstore: cleanup batch size must not be negative")
+	}
+	if o.maxCleanupRows < 0 {
+		return errors.New("postgresstore: maximum cleanup rows must not be negative")
+	}
+	if o.cleanupStrategy != "" && o.cleanupStrategy != CleanupDelete && o.cleanupStrategy != CleanupSkipLocked {
+		return fmt.Errorf("postgresstore: unknown cleanup strategy %q", o.cleanupStrategy)
+	}
+	if o.cleanupMaxInUseRatio < 0 || o.cleanupMaxInUseRatio > 1 {
+		return errors.New("postgresstore: cleanup pool guard ratio must be between 0 and 1")
+	}
+	if o.expiryGraceWindow < 0 {
+		return errors.New("postgresstore: expiry grace window must not be negative")
+	}
+	if o.cleanupThrottleRatio < 0 || o.cleanupThrottleRatio > 1 {
+		return errors.New("postgresstore: cleanup throttle ratio must be between 0 and 1")
+	}
+	if o.cleanupThrottleRatio > 0 && o.cleanupThrottleBatchSize <= 0 {
+		return errors.New("postgresstore: cleanup throttled batch size must be positive")
+	}
+	return nil
+}
+
+// quote replaces the configured table and column names with quoted
+// identifiers, if the WithQuotedIdentifiers option is used. Each part of a
+// schema-qualified table name is quoted separately.
+func (o *storeOptions) quote() {
+	if !o.quoteIdentifiers {
+		return
+	}
+
+	parts := strings.Split(o.sessionTableName, ".")
+	for i, part := range parts {
+		parts[i] = pq.QuoteIdentifier(part)
+	}
+	o.sessionTableName = strings.Join(parts, ".")
+
+	for _, name := range []*string{
+		&o.tokenColumnName, &o.dataColumnName, &o.expiryColumnName, &o.updatedAtColumnName,
+		&o.createdAtColumnName, &o.deletedAtColumnName, &o.subjectColumnName, &o.lookupColumnName, &o.claimColumnName, &o.typeColumnName, &o.absoluteExpiryColumnName, &o.versionColumnName,
+	} {
+		if *name != "" {
+			*name = pq.QuoteIdentifier(*name)
+		}
+	}
+}
+
+// WithWriteBehind makes Commit buffer writes in memory rather than writing
+// them to the database immediately. A background goroutine writes the buffered
+// sessions every flushInterval, or as soon as maxBatch sessions are waiting,
+// in a single transaction per batch, with one statement for up to 1000 of its
+// sessions. Repeated commits of a token before a flush are coalesced into one
+// write.
+//
+// This trades durability for throughput: sessions committed since the last
+// flush are lost if the process exits without calling Close or Flush, and if a
+// flush fails the sessions in that batch are discarded and the error is
+// logged. Find sees buffered sessions on the same store, but other processes
+// and the other methods which read from the database, such as All, only see
+// them once they have been flushed. Delete discards any buffered write for the
+// token, RotateToken writes any buffered commit of the old token before moving
+// it, keeping it buffered if the rotation fails, and DeleteCreatedBefore, DeleteOtherSessions and DeleteRange flush the
+// buffer before deleting, so that a flush can't bring back a session which
+// they removed. Drain flushes the buffer and holds later commits until
+// Undrain. CommitWithResult always reports a buffered commit as applied. The
+// other write methods, such as Touch and CreateNew, are not buffered, so call
+// Flush first if they must observe an earlier Commit.
+func WithWriteBehind(flushInterval time.Duration, maxBatch int) StoreOption {
+	return func(options *storeOptions) {
+		options.writeBehindInterval = flushInterval
+		options.writeBehindBatch = maxBatch
+	}
+}
+
+// WithEventSink publishes session lifecycle events to sink: SessionCreated or
+// SessionRefreshed after each successful Commit, SessionDeleted after each
+// Delete, and SessionExpired for each session removed by the cleanup. Telling
+// created sessions apart from refreshed ones relies on PostgreSQL's xmax
+// system column, so this is only supported with the default dialect.
+func WithEventSink(sink EventSink) StoreOption {
+	return func(options *storeOptions) {
+		options.eventSink = sink
+	}
+}
+
+// WithNowFunc makes the store compare expiry times against the time returned
+// by fn, rather than the database's current_timestamp, when checking whether
+// sessions are active and when the cleanup deletes expired sessions. This lets
+// tests control expiry with a fake clock. Times written by the store, such as
+// those in the updated-at and created-at columns, still come from the database.
+// It is only supported with the default PostgreSQL dialect.
+func WithNowFunc(fn func() time.Time) StoreOption {
+	return func(options *storeOptions) {
+		options.nowFunc = fn
+	}
+}
+
+// WithQuotedIdentifiers double-quotes the table and column names in the
+// generated SQL, so that names which were created with quotes, such as
+// "sessionToken", are matched exactly. Quoting a lower-case name has no
+// effect on which table or column it refers to. A table name containing a dot
+// is treated as schema-qualified.
+func WithQuotedIdentifiers() StoreOption {
+	return func(options *storeOptions) {
+		options.quoteIdentifiers = true
+	}
+}
+
 func WithSessionTableName(tableName string) StoreOption {
 	return func(options *storeOptions) {
 		options.sessionTableName = tableName
@@ -38,8 +276,622 @@ func WithExpiryColumnName(columnName string) StoreOption {
 	}
 }
 
+// WithUpdatedAtColumnName sets the name of an optional column which records
+// when each session was last committed. It is set with clock_timestamp(), the
+// time at which the write runs, rather than the start of its transaction. It
+// is required by ChangedSince and LastUpdated.
+func WithUpdatedAtColumnName(columnName string) StoreOption {
+	return func(options *storeOptions) {
+		options.updatedAtColumnName = columnName
+	}
+}
+
+// WithUpdatedAtOnChange makes Commit and Replace only set the updated-at
+// column of an existing session when its data changes, so that commits which
+// only extend the expiry of a session, as happens on every request with an
+// idle timeout, don't make it look changed to ChangedSince and LastUpdated.
+// Touch and the other methods which only update the expiry never set the
+// updated-at column. A single write can override this with WithUpdatedAt.
+// It requires WithUpdatedAtColumnName and cannot be used with
+// WithLargeObjectData.
+func WithUpdatedAtOnChange() StoreOption {
+	return func(options *storeOptions) {
+		options.updatedAtOnChange = true
+	}
+}
+
+// WithCreatedAtColumnName sets the name of an optional column which records
+// when each session was created. It is set when a session is first committed,
+// and kept when its token is rotated. It is required by DeleteCreatedBefore.
+func WithCreatedAtColumnName(columnName string) StoreOption {
+	return func(options *storeOptions) {
+		options.createdAtColumnName = columnName
+	}
+}
+
+// WithDeletedAtColumnName sets the name of an optional column which records
+// when each session was deleted, and makes Delete mark sessions as deleted
+// rather than removing them. A deleted session is no longer active, and its
+// row is removed by the cleanup once it expires, as it would have been
+// otherwise. Committing a deleted session clears the column. The bulk delete
+// methods and the cleanup still remove rows. It is required by
+// CountDeletedBetween.
+func WithDeletedAtColumnName(columnName string) StoreOption {
+	return func(options *storeOptions) {
+		options.deletedAtColumnName = columnName
+	}
+}
+
+// WithSubjectColumn sets the name of an optional column holding the subject
+// that each session belongs to, such as a user ID. It is required by the
+// methods which look up sessions by subject. If fn is not nil, Commit calls it
+// with the session token and data and stores the result in the column, with an
+// empty string stored as NULL. If fn is nil, Commit leaves the column
+// unchanged and it must be maintained by your application.
+func WithSubjectColumn(columnName string, fn func(token string, data []byte) string) StoreOption {
+	return func(options *storeOptions) {
+		options.subjectColumnName = columnName
+		options.subjectFunc = fn
+	}
+}
+
+// WithLookupColumn sets the name of an optional indexed column holding an
+// attribute of each session, such as a device ID, which is required by
+// FindByAttribute. The store never writes the column, so it must be
+// maintained by your application.
+func WithLookupColumn(columnName string) StoreOption {
+	return func(options *storeOptions) {
+		options.lookupColumnName = columnName
+	}
+}
+
+// WithType scopes the store to the sessions of type t, so that several kinds
+// of session, such as web sessions and API refresh tokens, can share one table
+// without the operations of one store reading, changing or deleting the
+// sessions of another. New sessions are written with t in the type column,
+// which is named "type" unless WithTypeColumnName is used, and every other
+// operation, including the background cleanup, only matches sessions of type
+// t. A store created without WithType matches sessions of every type.
+func WithType(t string) StoreOption {
+	return func(options *storeOptions) {
+		options.sessionType = t
+	}
+}
+
+// WithTypeColumnName sets the name of the column holding the type of each
+// session, which is used by stores created with the WithType option.
+func WithTypeColumnName(columnName string) StoreOption {
+	return func(options *storeOptions) {
+		options.typeColumnName = columnName
+	}
+}
+
+// WithClaimColumn sets the name of an optional TIMESTAMPTZ column holding the
+// time until which each session is claimed, which is required by TryClaim and
+// Release. The column is NULL for sessions which have never been claimed.
+func WithClaimColumn(columnName string) StoreOption {
+	return func(options *storeOptions) {
+		options.claimColumnName = columnName
+	}
+}
+
+// WithVersionColumnName sets the name of an optional integer column holding
+// the version of each session, which is 1 when a session is created and is
+// incremented each time its data is written. It is required by
+// FindWithVersion and CommitVersioned.
+func WithVersionColumnName(columnName string) StoreOption {
+	return func(options *storeOptions) {
+		options.versionColumnName = columnName
+	}
+}
+
+// WithAbsoluteExpiry sets the name of an optional column holding an absolute
+// expiry time for each session, which is independent of the sliding expiry in
+// the expiry column. When a session is created its absolute expiry is set to
+// the current time plus lifetime, and it is never changed afterwards. Commit,
+// Touch and the other methods which update the expiry cap it so that it is
+// never later than the absolute expiry, and sessions are treated as expired
+// once either time has passed.
+func WithAbsoluteExpiry(columnName string, lifetime time.Duration) StoreOption {
+	return func(options *storeOptions) {
+		options.absoluteExpiryColumnName = columnName
+		options.absoluteLifetime = lifetime
+	}
+}
+
+// WithTokenHMAC stores an HMAC-SHA256 of each session token, keyed with key,
+// in the token column instead of the token itself, so that the tokens can't be
+// recovered from the database. Lookups hash the given token and remain simple
+// equality matches on the token column. Methods which return tokens read from
+// the table, such as All, ChangedSince and the deleted tokens callback, return
+// the hex-encoded HMACs rather than the original tokens. Existing sessions
+// stored with plaintext tokens won't be found after enabling this option.
+func WithTokenHMAC(key []byte) StoreOption {
+	return func(options *storeOptions) {
+		options.tokenHMACKey = key
+	}
+}
+
+// WithActivePredicate replaces the SQL condition used to decide whether a
+// session is active, which by default compares the expiry column with the
+// current time. fn is called with the SQL expression for the current time and
+// should return a condition which is true for active sessions, for example:
+//
+//	func(now string) string {
+//		return "last_activity > " + now + " - interval '30 minutes'"
+//	}
+//
+// The condition is used by Find, All and the other read methods, and the
+// cleanup goroutine deletes the sessions for which it is false. The names in
+// the condition are not quoted or validated, so fn must not include untrusted
+// input.
+func WithActivePredicate(fn func(now string) string) StoreOption {
+	return func(options *storeOptions) {
+		options.activePredicate = fn
+	}
+}
+
+// WithAllRowLimit makes All, AllCtx, AllFunc, AllSlice, AllForSubject and
+// AllIncludingExpired return ErrTooManyRows when they would read more than n
+// sessions, rather than reading them all, which protects the database from
+// accidental reads of a very large table. AllFunc calls its function for the
+// first n sessions before returning the error. Use AllBatched or NewCursor for
+// reads which are meant to cover the whole table.
+func WithAllRowLimit(n int) StoreOption {
+	return func(options *storeOptions) {
+		options.allRowLimit = n
+	}
+}
+
+// WithCleanupPartitionFilter adds a condition to the queries which find and
+// delete expired sessions, so that the planner can prune the partitions of a
+// table partitioned by a column other than the expiry column. fn is called
+// with the SQL expression for the current time, in the same way as the
+// function passed to WithActivePredicate, and should return a condition on the
+// partition key, for example:
+//
+//	func(now string) string {
+//		return "created_at < " + now + " - interval '24 hours'"
+//	}
+//
+// Expired sessions for which the condition is false are left in place until it
+// becomes true. The condition is not quoted or validated, so fn must not
+// include untrusted input.
+func WithCleanupPartitionFilter(fn func(now string) string) StoreOption {
+	return func(options *storeOptions) {
+		options.cleanupPartitionFilter = fn
+	}
+}
+
+// WithJSONB indicates that the data column is a jsonb column rather than a
+// bytea column. Session data must then be valid JSON, for example by using a
+// JSON codec with the session manager. It is required by UpdateField.
+func WithJSONB() StoreOption {
+	return func(options *storeOptions) {
+		options.jsonb = true
+	}
+}
+
+// WithMergeOnConflict makes Commit merge the data into the stored data of an
+// existing session, using the jsonb || operator, rather than replacing it. The
+// merge is shallow: each top-level key in the committed data replaces the same
+// key in the stored data, nested objects are replaced rather than merged, and
+// keys which are only in the stored data are kept, so they can't be removed by
+// Commit. This lets concurrent requests which write different keys avoid
+// overwriting each other's changes. The session data must be a JSON object. It
+// requires WithJSONB, cannot be used with WithWriteBehind, and doesn't affect
+// Replace or CommitVersioned.
+func WithMergeOnConflict() StoreOption {
+	return func(options *storeOptions) {
+		options.mergeOnConflict = true
+	}
+}
+
+// WithLargeObjectData indicates that the data column is an oid column
+// referring to a PostgreSQL large object which holds the session data, rather
+// than a bytea column holding the data itself. This keeps the rows of the
+// sessions table small when the session data is very large. Commit writes the
+// data to a new large object and unlinks the previous one, and Delete and the
+// cleanup goroutine unlink the large objects of the sessions they delete. It
+// cannot be used with WithJSONB, WithConditionalUpdate, WithAbsoluteExpiry or
+// WithVersionColumnName.
+func WithLargeObjectData() StoreOption {
+	return func(options *storeOptions) {
+		options.largeObjectData = true
+	}
+}
+
+// WithDialect sets the Dialect used to generate SQL for the core store
+// operations. The default is PostgresDialect.
+func WithDialect(dialect Dialect) StoreOption {
+	return func(options *storeOptions) {
+		options.dialect = dialect
+	}
+}
+
 func WithCleanupInterval(interval time.Duration) StoreOption {
 	return func(options *storeOptions) {
 		options.cleanupInterval = interval
 	}
 }
+
+// WithSchemaCheck makes NewStore and NewWithContext check that the sessions
+// table and its expiry column exist before starting the background cleanup
+// goroutine, and return an error wrapping ErrTableMissing or ErrColumnMissing
+// if they don't. The check is only made when the cleanup interval is positive.
+func WithSchemaCheck() StoreOption {
+	return func(options *storeOptions) {
+		options.schemaCheck = true
+	}
+}
+
+// WithAdaptiveCleanup makes the background cleanup goroutine adjust its
+// interval to the workload, between min and max. The interval is halved after
+// a run which deletes many expired sessions, and doubled after a run which
+// deletes none. It starts from the cleanup interval, limited to the same
+// range.
+func WithAdaptiveCleanup(min, max time.Duration) StoreOption {
+	return func(options *storeOptions) {
+		options.minCleanupInterval = min
+		options.maxCleanupInterval = max
+	}
+}
+
+// WithoutCleanup disables the background cleanup goroutine, so expired
+// sessions are not removed. It is equivalent to WithCleanupInterval(0).
+func WithoutCleanup() StoreOption {
+	return WithCleanupInterval(0)
+}
+
+// WithFallbackOnError configures a store to be used in place of the database
+// when Find, Commit or Delete fail with a connection-level error. Logical
+// errors (such as a missing table) are still returned to the caller.
+//
+// Sessions written to the fallback store while the database is unavailable
+// are not copied back to the database when it recovers, so the two stores are
+// only eventually consistent. This is intended for non-critical session data
+// where serving a degraded experience is preferable to failing the request.
+func WithFallbackOnError(store Store) StoreOption {
+	return func(options *storeOptions) {
+		options.fallbackStore = store
+	}
+}
+
+// WithApplicationName sets the application_name reported in pg_stat_activity
+// while the background cleanup goroutine is deleting expired sessions, so that
+// its queries can be told apart from normal request traffic.
+func WithApplicationName(name string) StoreOption {
+	return func(options *storeOptions) {
+		options.applicationName = name
+	}
+}
+
+// WithRejectPastExpiry makes Commit, CreateNew and CommitVersioned return
+// ErrExpiryInPast, without writing anything, when the expiry time isn't in the
+// future. By default such sessions are written, and are immediately treated as
+// expired. A zero expiry time, meaning that the session never expires, is
+// always accepted.
+func WithRejectPastExpiry() StoreOption {
+	return func(options *storeOptions) {
+		options.rejectPastExpiry = true
+	}
+}
+
+// WithExpiryGraceWindow gives sessions a grace period of d after they expire,
+// so that a user who is in the middle of something can be asked to renew
+// their session rather than being logged out straight away. During the grace
+// period, Find, FindCtx, FindWithOptions and FindInto still return the
+// session, FindWithGrace reports that it is in its grace period, and the
+// cleanup leaves it in place. The other methods treat it as expired.
+func WithExpiryGraceWindow(d time.Duration) StoreOption {
+	return func(options *storeOptions) {
+		options.expiryGraceWindow = d
+	}
+}
+
+// WithConditionalUpdate makes Commit only overwrite an existing session if the
+// new expiry time is later than the stored one. This stops an older in-flight
+// request from overwriting a session which has since been refreshed. Use
+// CommitWithResult to find out whether the write was applied.
+func WithConditionalUpdate() StoreOption {
+	return func(options *storeOptions) {
+		options.conditionalUpdate = true
+	}
+}
+
+// WithExpiryOnlyUpdates makes Commit update only the expiry time of an
+// existing session whose stored data is the same as the data being committed,
+// rather than rewriting the whole row. This is the common case for sessions
+// with an idle timeout, which are committed on every request to extend their
+// lifetime, and it keeps the change stream seen by logical replication and CDC
+// pipelines down to the expiry changes. When the data has changed, the session
+// is written as usual, at the cost of an extra statement. The version column,
+// if any, isn't incremented by an expiry-only update. It cannot be used with
+// WithLargeObjectData.
+func WithExpiryOnlyUpdates() StoreOption {
+	return func(options *storeOptions) {
+		options.expiryOnlyUpdates = true
+	}
+}
+
+// WithIsolationLevel makes Commit and CommitVersioned run in a transaction at
+// the given isolation level, such as sql.LevelSerializable, rather than as a
+// single statement under the database's default isolation. If the transaction
+// fails with a serialization failure or a deadlock, it is retried up to
+// retries times before ErrSerializationFailure is returned. It cannot be used
+// with WithLargeObjectData.
+func WithIsolationLevel(level sql.IsolationLevel, retries int) StoreOption {
+	return func(options *storeOptions) {
+		options.isolationLevel = level
+		options.isolationRetries = retries
+	}
+}
+
+// WithReadCache enables a bounded, in-process LRU cache in front of Find. Up to
+// size sessions are cached, each for at most ttl (or until the session
+// expires, if that is sooner). Commit and Delete evict the token from the
+// cache of this store instance only; a Commit or Delete made through another
+// instance, for example on another server, won't be seen here until the
+// cached entry expires. A size of zero disables the cache. NewStore returns an
+// error if size is negative, or if the cache is enabled with a ttl which isn't
+// positive.
+func WithReadCache(size int, ttl time.Duration) StoreOption {
+	return func(options *storeOptions) {
+		options.readCacheSize = size
+		options.readCacheTTL = ttl
+	}
+}
+
+// WithCleanupOnStart makes the background cleanup goroutine delete expired
+// sessions as soon as it starts, rather than waiting for the first cleanup
+// interval to elapse. If you run many instances of your application, bear in
+// mind that they will all run a cleanup when they start at the same time.
+func WithCleanupOnStart() StoreOption {
+	return func(options *storeOptions) {
+		options.cleanupOnStart = true
+	}
+}
+
+// WithStopCleanupOnGC stops the background cleanup goroutine automatically
+// when the PostgresStore is garbage collected. This is a safety net for
+// transient stores, such as those created in tests, where StopCleanup might be
+// forgotten. Calling StopCleanup explicitly is still preferred, as there is no
+// guarantee of when, or whether, the garbage collector will run.
+func WithStopCleanupOnGC() StoreOption {
+	return func(options *storeOptions) {
+		options.stopCleanupOnGC = true
+	}
+}
+
+// WithDeletedTokensCallback sets a function which is called with the tokens of
+// the expired sessions removed by each run of the background cleanup
+// goroutine. It is not called if a run removes no sessions. Without this
+// option the cleanup doesn't fetch the deleted tokens.
+func WithDeletedTokensCallback(fn func(tokens []string)) StoreOption {
+	return func(options *storeOptions) {
+		options.deletedTokensCallback = fn
+	}
+}
+
+// WithCleanupExpiryHook sets a function which is called with the expiry times
+// of the expired sessions removed by each run of the background cleanup
+// goroutine, for example to record how long sessions had been expired before
+// they were removed. It is not called if a run removes no sessions. A session
+// with a NULL expiry, which can only be removed when using
+// WithActivePredicate, is reported with a zero time.Time. If the option is
+// used more than once, each of the functions is called, in order.
+func WithCleanupExpiryHook(fn func(expiries []time.Time)) StoreOption {
+	return func(options *storeOptions) {
+		prev := options.cleanupExpiryHook
+		if prev == nil || fn == nil {
+			options.cleanupExpiryHook = fn
+			return
+		}
+		options.cleanupExpiryHook = func(expiries []time.Time) {
+			prev(expiries)
+			fn(expiries)
+		}
+	}
+}
+
+// WithCleanupBatchSize makes the background cleanup goroutine delete expired
+// sessions in batches of at most n rows, each in its own statement, rather
+// than in a single DELETE. This keeps each statement short-lived on tables
+// with a large number of expired sessions.
+func WithCleanupBatchSize(n int) StoreOption {
+	return func(options *storeOptions) {
+		options.cleanupBatchSize = n
+	}
+}
+
+// WithSingleFlight makes concurrent Find calls for the same token share a
+// single query, so that a burst of requests for one hot session doesn't issue
+// the same query many times. Callers which join a query that is already in
+// progress receive its result, including its exists flag and any error, and
+// the same data slice, which must not be modified. A caller whose context is
+// cancelled while it waits gets the context's error, but the query is only
+// cancelled if the context of the caller which started it is.
+func WithSingleFlight() StoreOption {
+	return func(options *storeOptions) {
+		options.singleFlight = true
+	}
+}
+
+// WithSlowQueryThreshold calls handler with the name of the operation, such as
+// "Find" or "Commit", and how long it took, whenever a store method takes
+// longer than d. The time includes waiting for an operation slot when
+// WithMaxConcurrency is used. Methods which are wrappers for another method
+// report that method's name, so FindCtx reports "Find" and AllCtx reports
+// "All". The handler is called synchronously, before the method returns. A
+// threshold of zero reports every operation, for example to record metrics.
+// If the option is used more than once, each handler is called, in order,
+// when its own threshold is exceeded.
+func WithSlowQueryThreshold(d time.Duration, handler func(op string, d time.Duration)) StoreOption {
+	return func(options *storeOptions) {
+		prev, prevThreshold := options.slowQueryHandler, options.slowQueryThreshold
+		if prev == nil || handler == nil {
+			options.slowQueryThreshold = d
+			options.slowQueryHandler = handler
+			return
+		}
+		if d < options.slowQueryThreshold {
+			options.slowQueryThreshold = d
+		}
+		options.slowQueryHandler = func(op string, elapsed time.Duration) {
+			if elapsed > prevThreshold {
+				prev(op, elapsed)
+			}
+			if elapsed > d {
+				handler(op, elapsed)
+			}
+		}
+	}
+}
+
+// WithTokenLength sets the number of random bytes in the tokens generated by
+// NewSession. The default is 32, which is the same as the tokens generated by
+// scs. The token itself is longer, because it is base64-encoded.
+func WithTokenLength(n int) StoreOption {
+	return func(options *storeOptions) {
+		options.tokenLength = n
+	}
+}
+
+// WithTokenBinder makes the store pass each token through fn before binding it
+// as a query argument, so that it can be sent in the form a driver needs for a
+// token column which isn't text, such as a uuid.UUID for a uuid column. If
+// tokens are stored as HMACs, fn is passed the HMAC. Methods which take
+// several tokens, such as FindMany and TouchManyExpiries, still bind them as an
+// untyped array of strings, which PostgreSQL casts to the column's array type.
+func WithTokenBinder(fn func(token string) interface{}) StoreOption {
+	return func(options *storeOptions) {
+		options.tokenBinder = fn
+	}
+}
+
+// WithCleanupStrategy sets how the cleanup deletes expired sessions. Use
+// CleanupSkipLocked when every instance of an application runs the cleanup
+// against the same table, so that they share the work rather than blocking on
+// or deadlocking over the same rows. CleanupSkipLocked uses PostgreSQL syntax
+// regardless of the dialect.
+func WithCleanupStrategy(strategy CleanupStrategy) StoreOption {
+	return func(options *storeOptions) {
+		options.cleanupStrategy = strategy
+	}
+}
+
+// WithCleanupPoolGuard makes the background cleanup goroutine put off a run
+// while the ratio of in-use connections to sql.DB.SetMaxOpenConns in the pool
+// that the cleanup uses is above maxInUseRatio, so that it doesn't compete
+// with request traffic for connections during a spike. The run is retried
+// shortly afterwards. The guard has no effect if the pool has no limit on
+// open connections.
+func WithCleanupPoolGuard(maxInUseRatio float64) StoreOption {
+	return func(options *storeOptions) {
+		options.cleanupMaxInUseRatio = maxInUseRatio
+	}
+}
+
+// WithCleanupThrottle makes the background cleanup goroutine delete expired
+// sessions in batches of at most batchSize while the ratio of in-use
+// connections to sql.DB.SetMaxOpenConns in the pool that the cleanup uses is
+// above throttleRatio, so that each statement holds a connection and its locks
+// for less time while request traffic is high. The normal batch size is used
+// again once the ratio drops. Combine it with WithCleanupPoolGuard, using a
+// higher ratio, to put off runs entirely when the pool is close to saturated.
+// Like the guard, it has no effect if the pool has no limit on open
+// connections. CleanupThrottleState reports the current decision.
+func WithCleanupThrottle(throttleRatio float64, batchSize int) StoreOption {
+	return func(options *storeOptions) {
+		options.cleanupThrottleRatio = throttleRatio
+		options.cleanupThrottleBatchSize = batchSize
+	}
+}
+
+// WithMaxCleanupRows limits the number of expired sessions removed by each run
+// of the background cleanup goroutine to n. Any remaining expired sessions are
+// removed by later runs. When used with WithCleanupBatchSize, batches are
+// deleted until n rows in total have been removed.
+func WithMaxCleanupRows(n int) StoreOption {
+	return func(options *storeOptions) {
+		options.maxCleanupRows = n
+	}
+}
+
+// WithCleanupDB sets a separate database handle for the background cleanup
+// goroutine to use, so that its deletes don't compete with requests for
+// connections in the main pool. This can be a pool with a single connection.
+func WithCleanupDB(db *sql.DB) StoreOption {
+	return func(options *storeOptions) {
+		options.cleanupDB = db
+	}
+}
+
+// WithMaxConcurrency limits the number of store operations which can run
+// against the database at the same time to n, independently of the size of
+// the connection pool. Operations over the limit wait for a slot to become
+// free, or until their context is cancelled, unless WithFailFast is also used.
+// The background cleanup goroutine is not limited. A store passed to the
+// function given to ReadTx shares the slot used by ReadTx.
+func WithMaxConcurrency(n int) StoreOption {
+	return func(options *storeOptions) {
+		options.maxConcurrency = n
+	}
+}
+
+// WithFailFast makes operations over the limit set by WithMaxConcurrency
+// return ErrTooManyOperations immediately, rather than waiting, so that excess
+// load is shed.
+func WithFailFast() StoreOption {
+	return func(options *storeOptions) {
+		options.failFast = true
+	}
+}
+
+// WithSQLDebug logs the text of each SQL query to logger before it is run,
+// which can help when diagnosing problems with custom table or column names.
+// Query arguments, including session tokens and data, are never logged. If
+// logger is nil, queries are logged to standard error.
+func WithSQLDebug(logger *log.Logger) StoreOption {
+	return func(options *storeOptions) {
+		if logger == nil {
+			logger = log.New(os.Stderr, "", log.LstdFlags)
+		}
+		options.sqlDebugLogger = logger
+	}
+}
+
+// WithVersionComment prepends a comment naming this package and its version,
+// such as /* scs-postgresstore v1.2.3 */, to every query the store runs. This
+// lets queries from different services be grouped in pg_stat_statements, and
+// services running outdated versions be spotted. The version is read from the
+// build information of the running binary.
+func WithVersionComment() StoreOption {
+	return func(options *storeOptions) {
+		options.queryComment = fmt.Sprintf("/* scs-postgresstore %s */ ", moduleVersion())
+	}
+}
+
+type callOptions struct {
+	timeout     time.Duration
+	bypassCache bool
+}
+
+// CallOption adjusts the behaviour of a single call to FindWithOptions.
+type CallOption func(*callOptions)
+
+// WithCallTimeout sets a timeout for the call, in addition to any deadline of
+// the context passed to it.
+func WithCallTimeout(timeout time.Duration) CallOption {
+	return func(options *callOptions) {
+		options.timeout = timeout
+	}
+}
+
+// WithoutReadCache makes the call read the session from the database even if
+// it is in the read cache. The cache is still updated with the result.
+func WithoutReadCache() CallOption {
+	return func(options *callOptions) {
+		options.bypassCache = true
+	}
+}
@@ -1,46 +1,180 @@
 package postgresstore
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/lib/pq"
 )
 
 // PostgresStore represents the session store.
 type PostgresStore struct {
-	db          *sql.DB
+	db          *dbHandle
+	q           queryer   // The handle that queries run against. This is db, except in views returned by ReadTx and BindConn.
+	conn        *sql.Conn // The connection that transactions are started on, in views returned by BindConn.
 	stopCleanup chan bool
+	cleanupCtx  context.Context // The base context for cleanup queries, if NewWithContext was used.
+	cleanup     *cleanupStatus  // The state of the cleanup goroutine, shared with the store it runs on.
 	opts        *storeOptions
+
+	cache *readCache
+	sem   chan struct{} // Limits the number of concurrent operations, if WithMaxConcurrency was used.
+
+	writes *writeBuffer // Buffers commits, if WithWriteBehind was used.
+	finds  *findGroup   // Collapses concurrent finds, if WithSingleFlight was used.
+
+	mu       sync.Mutex
+	degraded bool
+	draining bool // Set by Drain.
+}
+
+// queryer is the set of query methods shared by *sql.DB, *sql.Tx and
+// *sql.Conn.
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Store is the interface for session stores which can be used as a fallback
+// by PostgresStore. It has the same method set as the scs.Store interface.
+type Store interface {
+	Delete(token string) (err error)
+	Find(token string) (b []byte, found bool, err error)
+	Commit(token string, b []byte, expiry time.Time) (err error)
 }
 
+const (
+	// defaultTokenLength is the number of random bytes in the tokens
+	// generated by NewSession, unless WithTokenLength is used.
+	defaultTokenLength = 32
+
+	// newSessionAttempts is how many tokens NewSession tries before giving
+	// up.
+	newSessionAttempts = 3
+)
+
 var defaultOptions = storeOptions{
 	sessionTableName: "sessions",
 	tokenColumnName:  "token",
 	dataColumnName:   "data",
 	expiryColumnName: "expiry",
+	typeColumnName:   "type",
 	cleanupInterval:  5 * time.Minute,
+	dialect:          PostgresDialect{},
 }
 
 // New returns a new PostgresStore instance, with a background cleanup goroutine
-// that runs every 5 minutes to remove expired session data.
+// that runs every 5 minutes to remove expired session data. It panics if the
+// store cannot be created; use NewStore if you want to handle the error.
 func New(db *sql.DB, options ...StoreOption) *PostgresStore {
+	return MustNew(db, options...)
+}
+
+// MustNew is like NewStore but panics with the error if the store cannot be
+// created. It simplifies initialising package-level variables and other places
+// where handling the error is awkward.
+func MustNew(db *sql.DB, options ...StoreOption) *PostgresStore {
+	p, err := NewStore(db, options...)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// NewStore returns a new PostgresStore instance, with a background cleanup
+// goroutine that runs every 5 minutes to remove expired session data. An error
+// is returned if the options are invalid.
+func NewStore(db *sql.DB, options ...StoreOption) (*PostgresStore, error) {
+	return NewWithContext(context.Background(), db, options...)
+}
+
+// NewWithContext is the same as NewStore, except that the queries run by the
+// background cleanup goroutine use ctx, so that values such as trace IDs which
+// are carried by ctx reach the driver and any instrumentation wrapping it. The
+// cleanup goroutine stops when ctx is cancelled.
+func NewWithContext(ctx context.Context, db *sql.DB, options ...StoreOption) (*PostgresStore, error) {
 	storeOpts := defaultOptions
 
 	for _, opt := range options {
 		opt(&storeOpts)
 	}
 
+	if db == nil {
+		return nil, ErrNilDB
+	}
+
+	err := storeOpts.validate()
+	if err != nil {
+		return nil, err
+	}
+	if storeOpts.schemaCheck && storeOpts.cleanupInterval > 0 {
+		err = checkSchema(ctx, db, &storeOpts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	storeOpts.quote()
+
 	p := &PostgresStore{
-		db:   db,
-		opts: &storeOpts,
+		db:         &dbHandle{db: db},
+		cleanupCtx: ctx,
+		opts:       &storeOpts,
+	}
+	p.q = p.wrapQueryer(p.db)
+
+	if p.opts.readCacheSize > 0 {
+		p.cache = newReadCache(p.opts.readCacheSize, p.opts.readCacheTTL)
+	}
+
+	if p.opts.maxConcurrency > 0 {
+		p.sem = make(chan struct{}, p.opts.maxConcurrency)
+	}
+
+	if p.opts.singleFlight {
+		p.finds = newFindGroup()
+	}
+
+	if p.opts.writeBehindInterval > 0 {
+		// Like the cleanup goroutine, the flusher runs against its own
+		// PostgresStore so that it doesn't keep p reachable.
+		p.writes = newWriteBuffer(p.opts.writeBehindBatch)
+		w := &PostgresStore{db: p.db, q: p.q, opts: p.opts}
+		go p.writes.run(w, p.opts.writeBehindInterval)
 	}
 
 	if p.opts.cleanupInterval > 0 {
-		go p.startCleanup(p.opts.cleanupInterval)
+		// The channel is buffered so that StopCleanup doesn't block if the
+		// goroutine is busy deleting expired sessions, or has already stopped.
+		p.stopCleanup = make(chan bool, 1)
+		p.cleanup = &cleanupStatus{running: true}
+
+		// The goroutine runs against its own PostgresStore sharing the same
+		// handles and options, so that it doesn't keep p reachable and the
+		// finalizer can run.
+		c := &PostgresStore{db: p.db, q: p.q, opts: p.opts, stopCleanup: p.stopCleanup, cleanupCtx: p.cleanupCtx, cleanup: p.cleanup}
+		go c.startCleanup(p.opts.cleanupInterval)
+		if p.opts.stopCleanupOnGC {
+			runtime.SetFinalizer(p, (*PostgresStore).StopCleanup)
+		}
 	}
 
-	return p
+	return p, nil
 }
 
 // NewWithCleanupInterval returns a new PostgresStore instance. The cleanupInterval
@@ -54,119 +188,2919 @@ func NewWithCleanupInterval(db *sql.DB, cleanupInterval time.Duration) *Postgres
 // Find returns the data for a given session token from the PostgresStore instance.
 // If the session token is not found or is expired, the returned exists flag will
 // be set to false.
+//
+// If the data column allows NULL, a session with NULL data is returned with nil
+// data and the exists flag set to true. The same applies to the other methods
+// which return session data, such as All and FindMany.
 func (p *PostgresStore) Find(token string) (b []byte, exists bool, err error) {
-	row := p.db.QueryRow(fmt.Sprintf(
-		"SELECT %s FROM %s WHERE %s = $1 AND current_timestamp < %s",
-		p.opts.dataColumnName, p.opts.sessionTableName, p.opts.tokenColumnName, p.opts.expiryColumnName,
-	), token)
+	return p.FindCtx(context.Background(), token)
+}
+
+// FindCtx is the same as Find, except it takes a context.Context.
+func (p *PostgresStore) FindCtx(ctx context.Context, token string) (b []byte, exists bool, err error) {
+	return p.FindWithOptions(ctx, token)
+}
+
+// FindWithOptions is the same as FindCtx, except that its behaviour can be
+// adjusted for this call only by passing CallOptions.
+func (p *PostgresStore) FindWithOptions(ctx context.Context, token string, opts ...CallOption) (b []byte, exists bool, err error) {
+	if err := p.checkDB(); err != nil {
+		return nil, false, err
+	}
+	defer p.observe("Find")()
+
+	var o callOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+	}
+
+	if p.writes != nil {
+		if b, expiry, ok := p.writes.get(token); ok {
+			if !expiry.IsZero() && !time.Now().Before(expiry.Add(p.opts.expiryGraceWindow)) {
+				return nil, false, nil
+			}
+			return b, true, nil
+		}
+	}
+
+	if p.cache != nil && !o.bypassCache {
+		if b, ok := p.cache.get(token); ok {
+			return b, true, nil
+		}
+	}
+
+	var expiry time.Time
+	if p.finds != nil {
+		b, expiry, exists, err = p.finds.do(ctx, token, func() ([]byte, time.Time, bool, error) {
+			return p.acquireAndFind(ctx, token)
+		})
+	} else {
+		b, expiry, exists, err = p.acquireAndFind(ctx, token)
+	}
+	if p.useFallback(err) {
+		return p.opts.fallbackStore.Find(token)
+	}
+	if exists && p.cache != nil {
+		p.cache.set(token, b, expiry)
+	}
+	return b, exists, err
+}
+
+// FindInto is the same as Find, except that the data is copied into *dst,
+// which is grown as needed, rather than into a newly allocated slice. Reusing
+// the same buffer across calls avoids allocating on each read, but the data
+// is overwritten by the next call, so it mustn't be retained or shared. If the
+// session doesn't exist, has expired or has NULL data, *dst is left empty.
+// Sessions read by FindInto aren't added to the read cache, and concurrent
+// reads aren't shared by WithSingleFlight.
+func (p *PostgresStore) FindInto(token string, dst *[]byte) (exists bool, err error) {
+	*dst = (*dst)[:0]
+	if err := p.checkDB(); err != nil {
+		return false, err
+	}
+	defer p.observe("FindInto")()
+
+	if p.writes != nil {
+		if b, expiry, ok := p.writes.get(token); ok {
+			if !expiry.IsZero() && !time.Now().Before(expiry.Add(p.opts.expiryGraceWindow)) {
+				return false, nil
+			}
+			*dst = append(*dst, b...)
+			return true, nil
+		}
+	}
+
+	if p.cache != nil {
+		if b, ok := p.cache.get(token); ok {
+			*dst = append(*dst, b...)
+			return true, nil
+		}
+	}
+
+	exists, err = p.findInto(token, dst)
+	if p.useFallback(err) {
+		b, exists, err := p.opts.fallbackStore.Find(token)
+		*dst = append(*dst, b...)
+		return exists, err
+	}
+	return exists, err
+}
+
+// findInto is the database read for FindInto. The row is read as sql.RawBytes,
+// which refers to the driver's own buffer, so that the only copy made is into
+// *dst.
+func (p *PostgresStore) findInto(token string, dst *[]byte) (bool, error) {
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		return false, err
+	}
+	defer release()
+
+	rows, err := p.q.QueryContext(context.Background(), p.findQuery(), p.tokenArg(token))
+	if err != nil {
+		return false, classifyError(err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return false, classifyError(rows.Err())
+	}
+	var b sql.RawBytes
+	var expiry sql.NullTime
+	if err := rows.Scan(&b, &expiry); err != nil {
+		return false, classifyError(err)
+	}
+	*dst = append(*dst, b...)
+	return true, classifyError(rows.Close())
+}
+
+// acquireAndFind is the same as find, except that it waits for an operation
+// slot first.
+func (p *PostgresStore) acquireAndFind(ctx context.Context, token string) (b []byte, expiry time.Time, exists bool, err error) {
+	release, err := p.acquire(ctx)
+	if err != nil {
+		return nil, time.Time{}, false, err
+	}
+	defer release()
+
+	return p.find(ctx, token)
+}
+
+func (p *PostgresStore) find(ctx context.Context, token string) (b []byte, expiry time.Time, exists bool, err error) {
+	row := p.q.QueryRowContext(ctx, p.findQuery(), p.tokenArg(token))
+	var nullExpiry sql.NullTime
+	err = row.Scan(&b, &nullExpiry)
+	if err == sql.ErrNoRows {
+		return nil, time.Time{}, false, nil
+	} else if err != nil {
+		return nil, time.Time{}, false, classifyError(err)
+	}
+	return b, nullExpiry.Time, true, nil
+}
+
+// FindTouching returns the data for a given session token, in the same way as
+// Find, and in the same statement extends the session's expiry to the current
+// time plus renewal if it has less than threshold of its lifetime remaining.
+// This renews sliding sessions when they are close to expiring, without
+// issuing a write on every request. Sessions which never expire are not
+// changed, and nor is any session while the store is in drain mode.
+func (p *PostgresStore) FindTouching(token string, renewal, threshold time.Duration) (b []byte, exists bool, err error) {
+	if err := p.checkDB(); err != nil {
+		return nil, false, err
+	}
+	if p.Draining() {
+		return p.Find(token)
+	}
+	defer p.observe("FindTouching")()
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		return nil, false, err
+	}
+	defer release()
+
+	args := &queryArgs{dialect: p.opts.dialect}
+	tokenPlaceholder := args.add(p.tokenArg(token))
+	renewalPlaceholder := args.add(renewal.Seconds())
+	thresholdPlaceholder := args.add(threshold.Seconds())
+	row := p.q.QueryRowContext(context.Background(), fmt.Sprintf(
+		`WITH s AS (SELECT %s, %s FROM %s WHERE %s = %s AND %s),
+		u AS (UPDATE %s SET %s = %s FROM s WHERE %s.%s = s.%s AND s.%s < %s + %s * interval '1 second')
+		SELECT %s FROM s`,
+		p.opts.tokenColumnName, p.opts.dataColumnName, p.opts.sessionTableName, p.opts.tokenColumnName, tokenPlaceholder, p.activePredicate(),
+		p.opts.sessionTableName, p.opts.expiryColumnName, p.capExpiry(p.nowExpr()+" + "+renewalPlaceholder+" * interval '1 second'"),
+		p.opts.sessionTableName, p.opts.tokenColumnName, p.opts.tokenColumnName, p.opts.expiryColumnName, p.nowExpr(), thresholdPlaceholder,
+		p.dataExpr(),
+	), args.values...)
 	err = row.Scan(&b)
 	if err == sql.ErrNoRows {
 		return nil, false, nil
 	} else if err != nil {
-		return nil, false, err
+		return nil, false, classifyError(err)
 	}
 	return b, true, nil
 }
 
-// Commit adds a session token and data to the PostgresStore instance with the
-// given expiry time. If the session token already exists, then the data and expiry
-// time are updated.
-func (p *PostgresStore) Commit(token string, b []byte, expiry time.Time) error {
-	_, err := p.db.Exec(fmt.Sprintf(
-		"INSERT INTO %s (%s, %s, %s) VALUES ($1, $2, $3) ON CONFLICT (%s) DO UPDATE SET %s = EXCLUDED.%s, %s = EXCLUDED.%s",
-		p.opts.sessionTableName, p.opts.tokenColumnName, p.opts.dataColumnName, p.opts.expiryColumnName,
-		p.opts.tokenColumnName, p.opts.dataColumnName, p.opts.dataColumnName, p.opts.expiryColumnName,
-		p.opts.expiryColumnName,
-	), token, b, expiry)
+// SessionInfo holds the data and expiry time of a session. A zero Expiry means
+// that the session never expires. Token is only set by SiblingSessions,
+// AllSlice, AllIncludingExpired, FindByAttribute and Cursor.Next, and Current
+// only by SiblingSessions.
+type SessionInfo struct {
+	Token   string
+	Data    []byte
+	Expiry  time.Time
+	Current bool
+}
+
+// FindMany returns the data for each of the given session tokens in a single
+// query. The returned map only contains entries for tokens which were found and
+// have not expired.
+func (p *PostgresStore) FindMany(tokens []string) (map[string][]byte, error) {
+	infos, err := p.FindManyWithExpiry(tokens)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
-}
 
-// Delete removes a session token and corresponding data from the PostgresStore
-// instance.
-func (p *PostgresStore) Delete(token string) error {
-	_, err := p.db.Exec(fmt.Sprintf(
-		"DELETE FROM %s WHERE %s = $1",
-		p.opts.sessionTableName, p.opts.tokenColumnName,
-	), token)
-	return err
+	sessions := make(map[string][]byte, len(infos))
+	for token, info := range infos {
+		sessions[token] = info.Data
+	}
+	return sessions, nil
 }
 
-// All returns a map containing the token and data for all active (i.e.
-// not expired) sessions in the PostgresStore instance.
-func (p *PostgresStore) All() (map[string][]byte, error) {
-	rows, err := p.db.Query(fmt.Sprintf(
-		"SELECT %s, %s FROM %s WHERE current_timestamp < %s",
-		p.opts.tokenColumnName, p.opts.dataColumnName, p.opts.sessionTableName, p.opts.expiryColumnName,
-	))
+// FindManyWithExpiry is the same as FindMany, except that it returns the
+// expiry time of each session along with its data.
+func (p *PostgresStore) FindManyWithExpiry(tokens []string) (map[string]SessionInfo, error) {
+	if err := p.checkDB(); err != nil {
+		return nil, err
+	}
+	defer p.observe("FindMany")()
+	release, err := p.acquire(context.Background())
 	if err != nil {
 		return nil, err
 	}
+	defer release()
+
+	args := &queryArgs{dialect: p.opts.dialect}
+	tokensPlaceholder := args.add(pq.Array(p.storedTokens(tokens)))
+	rows, err := p.q.QueryContext(context.Background(), fmt.Sprintf(
+		"SELECT %s, %s, %s FROM %s WHERE %s = ANY(%s) AND %s",
+		p.opts.tokenColumnName, p.dataExpr(), p.opts.expiryColumnName, p.opts.sessionTableName, p.opts.tokenColumnName, tokensPlaceholder, p.activePredicate(),
+	), args.values...)
+	if err != nil {
+		return nil, classifyError(err)
+	}
 	defer rows.Close()
 
-	sessions := make(map[string][]byte)
+	// When tokens are stored as HMACs, the tokens read back need mapping to
+	// the ones which were passed in.
+	var original map[string]string
+	if p.opts.tokenHMACKey != nil {
+		original = make(map[string]string, len(tokens))
+		for _, token := range tokens {
+			original[p.storedToken(token)] = token
+		}
+	}
+
+	sessions := make(map[string]SessionInfo, len(tokens))
 
 	for rows.Next() {
 		var (
-			token string
-			data  []byte
+			token  string
+			data   []byte
+			expiry sql.NullTime
 		)
 
-		err = rows.Scan(&token, &data)
+		err = rows.Scan(&token, &data, &expiry)
 		if err != nil {
-			return nil, err
+			return nil, classifyError(err)
+		}
+		if original != nil {
+			token = original[token]
 		}
 
-		sessions[token] = data
+		sessions[token] = SessionInfo{Data: data, Expiry: expiry.Time}
 	}
 
 	err = rows.Err()
 	if err != nil {
-		return nil, err
+		return nil, classifyError(err)
 	}
 
 	return sessions, nil
 }
 
-func (p *PostgresStore) startCleanup(interval time.Duration) {
-	p.stopCleanup = make(chan bool)
-	ticker := time.NewTicker(interval)
-	for {
-		select {
-		case <-ticker.C:
-			err := p.deleteExpired()
+// FilterActive returns those of the given session tokens which belong to
+// active sessions, in the order they were given, without reading the session
+// data. Tokens which don't exist or have expired are left out, as are
+// duplicates. If none of the tokens are active, an empty slice is returned.
+func (p *PostgresStore) FilterActive(tokens []string) ([]string, error) {
+	if err := p.checkDB(); err != nil {
+		return nil, err
+	}
+	defer p.observe("FilterActive")()
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	args := &queryArgs{dialect: p.opts.dialect}
+	tokensPlaceholder := args.add(pq.Array(p.storedTokens(tokens)))
+	rows, err := p.q.QueryContext(context.Background(), fmt.Sprintf(
+		"SELECT %s FROM %s WHERE %s = ANY(%s) AND %s",
+		p.opts.tokenColumnName, p.opts.sessionTableName, p.opts.tokenColumnName, tokensPlaceholder, p.activePredicate(),
+	), args.values...)
+	if err != nil {
+		return nil, classifyError(err)
+	}
+	defer rows.Close()
+
+	active := make(map[string]bool)
+
+	for rows.Next() {
+		var token string
+		err = rows.Scan(&token)
+		if err != nil {
+			return nil, classifyError(err)
+		}
+		active[token] = true
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, classifyError(err)
+	}
+
+	filtered := []string{}
+	for _, token := range tokens {
+		stored := p.storedToken(token)
+		if active[stored] {
+			filtered = append(filtered, token)
+			delete(active, stored)
+		}
+	}
+
+	return filtered, nil
+}
+
+// Commit adds a session token and data to the PostgresStore instance with the
+// given expiry time. If the session token already exists, then the data and expiry
+// time are updated. A zero expiry time means that the session never expires.
+// Expiry times are stored in UTC, whatever the location of the given time.
+func (p *PostgresStore) Commit(token string, b []byte, expiry time.Time) error {
+	return p.CommitCtx(context.Background(), token, b, expiry)
+}
+
+// CommitCtx is the same as Commit, except it takes a context.Context.
+func (p *PostgresStore) CommitCtx(ctx context.Context, token string, b []byte, expiry time.Time) error {
+	_, err := p.CommitWithResult(ctx, token, b, expiry)
+	return err
+}
+
+// CommitWithResult is the same as CommitCtx, except it also reports whether
+// the session was written. This is always true on success, unless the store
+// was created with the WithConditionalUpdate option and the stored expiry is
+// newer than the given one.
+func (p *PostgresStore) CommitWithResult(ctx context.Context, token string, b []byte, expiry time.Time) (applied bool, err error) {
+	if err := p.checkDB(); err != nil {
+		return false, err
+	}
+	defer p.observe("Commit")()
+	if err := p.checkWritable(); err != nil {
+		return false, err
+	}
+	if err := p.checkExpiry(expiry); err != nil {
+		return false, err
+	}
+	release, err := p.acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+
+	if p.cache != nil {
+		p.cache.remove(token)
+	}
+
+	if p.writes != nil {
+		if updatedAtMode(ctx) == UpdatedAtDefault {
+			if p.writes.add(token, b, expiry) {
+				return true, nil
+			}
+		} else {
+			// The commit is written directly, and supersedes any buffered
+			// write of the session.
+			p.writes.discard(token)
+		}
+	}
+
+	err = p.writeTx(ctx, func(view *PostgresStore) error {
+		applied, err = view.commit(ctx, token, b, expiry)
+		return err
+	})
+	if p.useFallback(err) {
+		return true, p.opts.fallbackStore.Commit(token, b, expiry)
+	}
+	return applied, err
+}
+
+func (p *PostgresStore) commit(ctx context.Context, token string, b []byte, expiry time.Time) (bool, error) {
+	mode := updatedAtMode(ctx)
+	if p.opts.largeObjectData {
+		return p.commitLargeObject(ctx, token, b, expiry, mode)
+	}
+
+	if p.opts.expiryOnlyUpdates && mode != UpdatedAtForce {
+		query, args := p.touchUnchangedQuery(token, b, expiry)
+		res, err := p.q.ExecContext(ctx, query, args...)
+		if err != nil {
+			return false, classifyError(err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return false, err
+		}
+		if n > 0 {
+			p.publish(SessionRefreshed, token, expiry)
+			return true, nil
+		}
+	}
+
+	query, args := p.commitManyQuery([]pendingWrite{{token: token, data: b, expiry: expiry, updatedAt: mode}})
+	if p.opts.eventSink != nil {
+		// The xmax system column is zero for a row which was inserted, rather
+		// than updated, by the statement.
+		var created bool
+		err := p.q.QueryRowContext(ctx, query+" RETURNING (xmax = 0)", args...).Scan(&created)
+		if err == sql.ErrNoRows {
+			return false, nil
+		} else if err != nil {
+			return false, classifyError(err)
+		}
+		if created {
+			p.publish(SessionCreated, token, expiry)
+		} else {
+			p.publish(SessionRefreshed, token, expiry)
+		}
+		return true, nil
+	}
+
+	res, err := p.q.ExecContext(ctx, query, args...)
+	if err != nil {
+		return false, classifyError(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// commitLargeObject is the same as commit, for stores created with the
+// WithLargeObjectData option. The data is written to a new large object, and
+// the large object holding the previous data, if any, is unlinked in the same
+// transaction.
+func (p *PostgresStore) commitLargeObject(ctx context.Context, token string, b []byte, expiry time.Time, mode UpdatedAtMode) (bool, error) {
+	tx, err := p.beginTx(ctx, nil)
+	if err != nil {
+		return false, classifyError(err)
+	}
+	defer tx.Rollback()
+	q := p.wrapQueryer(tx)
+
+	lockArgs := &queryArgs{dialect: p.opts.dialect}
+	tokenPlaceholder := lockArgs.add(p.tokenArg(token))
+	var oldData sql.NullInt64
+	err = q.QueryRowContext(ctx, fmt.Sprintf(
+		"SELECT %s FROM %s WHERE %s = %s%s FOR UPDATE",
+		p.opts.dataColumnName, p.opts.sessionTableName, p.opts.tokenColumnName, tokenPlaceholder, p.typeFilter(),
+	), lockArgs.values...).Scan(&oldData)
+	if err != nil && err != sql.ErrNoRows {
+		return false, classifyError(err)
+	}
+	exists := err == nil
+
+	args := &queryArgs{dialect: p.opts.dialect}
+	columns := []string{p.opts.tokenColumnName, p.opts.dataColumnName, p.opts.expiryColumnName}
+	values := []string{args.add(p.tokenArg(token)), "lo_from_bytea(0, " + args.add(b) + ")", args.add(expiryValue(expiry))}
+	if p.opts.updatedAtColumnName != "" {
+		columns = append(columns, p.opts.updatedAtColumnName)
+		values = append(values, p.updatedAtExpr())
+	}
+	if p.opts.subjectFunc != nil {
+		columns = append(columns, p.opts.subjectColumnName)
+		values = append(values, args.add(nullString(p.opts.subjectFunc(token, b))))
+	}
+	if p.opts.sessionType != "" {
+		columns = append(columns, p.opts.typeColumnName)
+		values = append(values, args.add(p.opts.sessionType))
+	}
+	if p.opts.deletedAtColumnName != "" {
+		columns = append(columns, p.opts.deletedAtColumnName)
+		values = append(values, "NULL")
+	}
+
+	if exists {
+		var sets []string
+		for i := 1; i < len(columns); i++ {
+			if columns[i] == p.opts.updatedAtColumnName && mode == UpdatedAtSuppress {
+				continue
+			}
+			sets = append(sets, fmt.Sprintf("%s = %s", columns[i], values[i]))
+		}
+		_, err = q.ExecContext(ctx, fmt.Sprintf(
+			"UPDATE %s SET %s WHERE %s = %s%s",
+			p.opts.sessionTableName, strings.Join(sets, ", "), p.opts.tokenColumnName, values[0], p.typeFilter(),
+		), args.values...)
+		if err != nil {
+			return false, classifyError(err)
+		}
+		if oldData.Valid {
+			_, err = q.ExecContext(ctx, "SELECT lo_unlink($1)", oldData.Int64)
 			if err != nil {
-				log.Println(err)
+				return false, classifyError(err)
 			}
-		case <-p.stopCleanup:
-			ticker.Stop()
-			return
 		}
+	} else {
+		if p.opts.createdAtColumnName != "" {
+			columns = append(columns, p.opts.createdAtColumnName)
+			values = append(values, "current_timestamp")
+		}
+		_, err = q.ExecContext(ctx, fmt.Sprintf(
+			"INSERT INTO %s (%s) VALUES (%s)",
+			p.opts.sessionTableName, strings.Join(columns, ", "), strings.Join(values, ", "),
+		), args.values...)
+		if err != nil {
+			return false, classifyError(err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, classifyError(err)
 	}
+	if exists {
+		p.publish(SessionRefreshed, token, expiry)
+	} else {
+		p.publish(SessionCreated, token, expiry)
+	}
+	return true, nil
 }
 
-// StopCleanup terminates the background cleanup goroutine for the PostgresStore
-// instance. It's rare to terminate this; generally PostgresStore instances and
-// their cleanup goroutines are intended to be long-lived and run for the lifetime
-// of your application.
-//
-// There may be occasions though when your use of the PostgresStore is transient.
-// An example is creating a new PostgresStore instance in a test function. In this
-// scenario, the cleanup goroutine (which will run forever) will prevent the
-// PostgresStore object from being garbage collected even after the test function
-// has finished. You can prevent this by manually calling StopCleanup.
-func (p *PostgresStore) StopCleanup() {
-	if p.stopCleanup != nil {
-		p.stopCleanup <- true
+// ReapOrphanedData unlinks the large objects which aren't referenced by any
+// row of the sessions table, and returns the number unlinked. Commit, Delete
+// and the cleanup never leave orphaned large objects behind, but rows deleted
+// by other means, such as a manual DELETE, do. Only large objects owned by the
+// current database role are considered, so the role which the store connects
+// as must not own large objects used for anything else. The large objects and
+// the rows referring to them are read from the same snapshot, so it is safe to
+// run concurrently with the other methods. The store must have been created
+// with the WithLargeObjectData option.
+func (p *PostgresStore) ReapOrphanedData(ctx context.Context) (int, error) {
+	if err := p.checkDB(); err != nil {
+		return 0, err
 	}
+	defer p.observe("ReapOrphanedData")()
+	if err := p.checkWritable(); err != nil {
+		return 0, err
+	}
+	if !p.opts.largeObjectData {
+		return 0, notConfigured("WithLargeObjectData")
+	}
+	release, err := p.acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	var n int
+	err = p.q.QueryRowContext(ctx, fmt.Sprintf(
+		`SELECT count(lo_unlink(m.oid)) FROM pg_largeobject_metadata m
+		WHERE m.lomowner = (SELECT oid FROM pg_roles WHERE rolname = current_user)
+		AND NOT EXISTS (SELECT 1 FROM %s s WHERE s.%s = m.oid)`,
+		p.opts.sessionTableName, p.opts.dataColumnName,
+	)).Scan(&n)
+	if err != nil {
+		return 0, classifyError(err)
+	}
+	return n, nil
 }
 
-func (p *PostgresStore) deleteExpired() error {
-	_, err := p.db.Exec(fmt.Sprintf(
-		"DELETE FROM %s WHERE %s < current_timestamp",
-		p.opts.sessionTableName, p.opts.expiryColumnName,
-	))
-	return err
+// FindWithVersion is the same as Find, except that it also returns the version
+// of the session, for passing to CommitVersioned. It always reads from the
+// database, bypassing the read cache and fallback store. The store must have
+// been created with the WithVersionColumnName option.
+func (p *PostgresStore) FindWithVersion(token string) (b []byte, version int64, exists bool, err error) {
+	if err := p.checkDB(); err != nil {
+		return nil, 0, false, err
+	}
+	defer p.observe("FindWithVersion")()
+	if p.opts.versionColumnName == "" {
+		return nil, 0, false, notConfigured("WithVersionColumnName")
+	}
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		return nil, 0, false, err
+	}
+	defer release()
+
+	args := &queryArgs{dialect: p.opts.dialect}
+	tokenPlaceholder := args.add(p.tokenArg(token))
+	row := p.q.QueryRowContext(context.Background(), fmt.Sprintf(
+		"SELECT %s, %s FROM %s WHERE %s = %s AND %s",
+		p.dataExpr(), p.opts.versionColumnName, p.opts.sessionTableName, p.opts.tokenColumnName, tokenPlaceholder, p.activePredicate(),
+	), args.values...)
+	err = row.Scan(&b, &version)
+	if err == sql.ErrNoRows {
+		return nil, 0, false, nil
+	} else if err != nil {
+		return nil, 0, false, classifyError(err)
+	}
+	return b, version, true, nil
+}
+
+// FindIncludingExpired returns the data and expiry time of a session, whether
+// or not it has expired, as long as it hasn't been removed by the cleanup yet.
+// A zero expiry time means that the session never expires. It always reads
+// from the database, bypassing the read cache and fallback store. It is
+// intended for inspecting sessions during incident investigations, and must
+// not be used to authenticate requests.
+func (p *PostgresStore) FindIncludingExpired(token string) (b []byte, expiry time.Time, exists bool, err error) {
+	if err := p.checkDB(); err != nil {
+		return nil, time.Time{}, false, err
+	}
+	defer p.observe("FindIncludingExpired")()
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		return nil, time.Time{}, false, err
+	}
+	defer release()
+
+	var stored sql.NullTime
+	args := &queryArgs{dialect: p.opts.dialect}
+	tokenPlaceholder := args.add(p.tokenArg(token))
+	row := p.q.QueryRowContext(context.Background(), fmt.Sprintf(
+		"SELECT %s, %s FROM %s WHERE %s = %s%s",
+		p.dataExpr(), p.opts.expiryColumnName, p.opts.sessionTableName, p.opts.tokenColumnName, tokenPlaceholder, p.typeFilter(),
+	), args.values...)
+	err = row.Scan(&b, &stored)
+	if err == sql.ErrNoRows {
+		return nil, time.Time{}, false, nil
+	} else if err != nil {
+		return nil, time.Time{}, false, classifyError(err)
+	}
+	return b, stored.Time, true, nil
+}
+
+// FindWithGrace is the same as Find, except that it also reports whether the
+// session has expired and is in the grace period set with
+// WithExpiryGraceWindow, so that the application can prompt the user to renew
+// it. It always reads from the database, bypassing the read cache.
+func (p *PostgresStore) FindWithGrace(token string) (b []byte, exists, inGrace bool, err error) {
+	if err := p.checkDB(); err != nil {
+		return nil, false, false, err
+	}
+	defer p.observe("FindWithGrace")()
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		return nil, false, false, err
+	}
+	defer release()
+
+	now := p.nowExpr()
+	args := &queryArgs{dialect: p.opts.dialect}
+	tokenPlaceholder := args.add(p.tokenArg(token))
+	row := p.q.QueryRowContext(context.Background(), fmt.Sprintf(
+		"SELECT %s, NOT %s FROM %s WHERE %s = %s AND %s",
+		p.dataExpr(), p.activePredicateAt(now), p.opts.sessionTableName, p.opts.tokenColumnName, tokenPlaceholder, p.activePredicateAt(p.graceExpr(now)),
+	), args.values...)
+	err = row.Scan(&b, &inGrace)
+	if err == sql.ErrNoRows {
+		return nil, false, false, nil
+	} else if err != nil {
+		return nil, false, false, classifyError(err)
+	}
+	return b, true, inGrace, nil
+}
+
+// SessionRecord holds an active session together with the values of the
+// optional columns that the store is configured with, as returned by FindFull.
+// The fields for columns which aren't configured are left as zero values, as
+// are those for NULL values.
+type SessionRecord struct {
+	Data           []byte
+	Expiry         time.Time
+	AbsoluteExpiry time.Time // Requires WithAbsoluteExpiry.
+	Subject        string    // Requires WithSubjectColumn.
+	CreatedAt      time.Time // Requires WithCreatedAtColumnName.
+	UpdatedAt      time.Time // Requires WithUpdatedAtColumnName.
+	Version        int64     // Requires WithVersionColumnName.
+}
+
+// FindFull is the same as Find, except that it returns the session along with
+// all of the optional columns that the store is configured with, read in a
+// single query. It always reads from the database, bypassing the read cache and
+// fallback store. If the session doesn't exist or has expired, exists is false.
+func (p *PostgresStore) FindFull(token string) (record *SessionRecord, exists bool, err error) {
+	if err := p.checkDB(); err != nil {
+		return nil, false, err
+	}
+	defer p.observe("FindFull")()
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		return nil, false, err
+	}
+	defer release()
+
+	var (
+		r                      SessionRecord
+		expiry, absoluteExpiry sql.NullTime
+		createdAt, updatedAt   sql.NullTime
+		subject                sql.NullString
+		version                sql.NullInt64
+	)
+	columns := []string{p.dataExpr(), p.opts.expiryColumnName}
+	dest := []interface{}{&r.Data, &expiry}
+	if p.opts.absoluteExpiryColumnName != "" {
+		columns = append(columns, p.opts.absoluteExpiryColumnName)
+		dest = append(dest, &absoluteExpiry)
+	}
+	if p.opts.subjectColumnName != "" {
+		columns = append(columns, p.opts.subjectColumnName)
+		dest = append(dest, &subject)
+	}
+	if p.opts.createdAtColumnName != "" {
+		columns = append(columns, p.opts.createdAtColumnName)
+		dest = append(dest, &createdAt)
+	}
+	if p.opts.updatedAtColumnName != "" {
+		columns = append(columns, p.opts.updatedAtColumnName)
+		dest = append(dest, &updatedAt)
+	}
+	if p.opts.versionColumnName != "" {
+		columns = append(columns, p.opts.versionColumnName)
+		dest = append(dest, &version)
+	}
+
+	args := &queryArgs{dialect: p.opts.dialect}
+	tokenPlaceholder := args.add(p.tokenArg(token))
+	err = p.q.QueryRowContext(context.Background(), fmt.Sprintf(
+		"SELECT %s FROM %s WHERE %s = %s AND %s",
+		strings.Join(columns, ", "), p.opts.sessionTableName, p.opts.tokenColumnName, tokenPlaceholder, p.activePredicate(),
+	), args.values...).Scan(dest...)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, classifyError(err)
+	}
+
+	r.Expiry = expiry.Time
+	r.AbsoluteExpiry = absoluteExpiry.Time
+	r.Subject = subject.String
+	r.CreatedAt = createdAt.Time
+	r.UpdatedAt = updatedAt.Time
+	r.Version = version.Int64
+	return &r, true, nil
+}
+
+// CommitVersioned is the same as Commit, except that it only writes the
+// session if its stored version is expectedVersion, as returned by
+// FindWithVersion, and it returns the new version. An expectedVersion of zero
+// means that the session must not exist yet. If the version doesn't match,
+// ErrVersionConflict is returned and nothing is changed, so the caller can
+// read the session again and retry. The store must have been created with the
+// WithVersionColumnName option.
+func (p *PostgresStore) CommitVersioned(token string, b []byte, expiry time.Time, expectedVersion int64) (version int64, err error) {
+	if err := p.checkDB(); err != nil {
+		return 0, err
+	}
+	defer p.observe("CommitVersioned")()
+	if err := p.checkWritable(); err != nil {
+		return 0, err
+	}
+	if err := p.checkExpiry(expiry); err != nil {
+		return 0, err
+	}
+	if p.opts.versionColumnName == "" {
+		return 0, notConfigured("WithVersionColumnName")
+	}
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	if p.cache != nil {
+		p.cache.remove(token)
+	}
+
+	columns, values, args := p.commitColumns(token, b, expiry)
+	var query string
+	if expectedVersion == 0 {
+		columns, values = p.createColumns(columns, values, args)
+		query = fmt.Sprintf(
+			"INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (%s) DO NOTHING RETURNING %s",
+			p.opts.sessionTableName, strings.Join(columns, ", "), strings.Join(values, ", "),
+			p.opts.tokenColumnName, p.opts.versionColumnName,
+		)
+	} else {
+		sets := make([]string, len(columns)-1)
+		for i := range sets {
+			sets[i] = fmt.Sprintf("%s = %s", columns[i+1], values[i+1])
+		}
+		sets[1] = fmt.Sprintf("%s = %s", p.opts.expiryColumnName, p.capExpiry(values[2]))
+		sets = append(sets, fmt.Sprintf("%s = %s + 1", p.opts.versionColumnName, p.opts.versionColumnName))
+		query = fmt.Sprintf(
+			"UPDATE %s SET %s WHERE %s = %s AND %s = %s AND %s RETURNING %s",
+			p.opts.sessionTableName, strings.Join(sets, ", "), p.opts.tokenColumnName, values[0],
+			p.opts.versionColumnName, args.add(expectedVersion), p.activePredicate(), p.opts.versionColumnName,
+		)
+	}
+
+	err = p.writeTx(context.Background(), func(view *PostgresStore) error {
+		return view.q.QueryRowContext(context.Background(), query, args.values...).Scan(&version)
+	})
+	if err == sql.ErrNoRows {
+		return 0, ErrVersionConflict
+	} else if err != nil {
+		return 0, classifyError(err)
+	}
+	return version, nil
+}
+
+// CreateNew adds a new session with the given data and expiry time, but only if
+// the session token doesn't already exist. Unlike Commit, it never overwrites
+// an existing session, including one which has expired but not yet been removed
+// by the cleanup. It reports whether the session was created. CreateNew is not
+// supported by stores created with the WithLargeObjectData option.
+func (p *PostgresStore) CreateNew(token string, b []byte, expiry time.Time) (created bool, err error) {
+	if err := p.checkDB(); err != nil {
+		return false, err
+	}
+	defer p.observe("CreateNew")()
+	if err := p.checkWritable(); err != nil {
+		return false, err
+	}
+	if err := p.checkExpiry(expiry); err != nil {
+		return false, err
+	}
+	if p.opts.largeObjectData {
+		return false, fmt.Errorf("postgresstore: CreateNew is not supported with WithLargeObjectData")
+	}
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		return false, err
+	}
+	defer release()
+
+	if p.cache != nil {
+		p.cache.remove(token)
+	}
+
+	columns, values, args := p.commitColumns(token, b, expiry)
+	columns, values = p.createColumns(columns, values, args)
+	res, err := p.q.ExecContext(context.Background(), fmt.Sprintf(
+		"INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (%s) DO NOTHING",
+		p.opts.sessionTableName, strings.Join(columns, ", "), strings.Join(values, ", "), p.opts.tokenColumnName,
+	), args.values...)
+	if err != nil {
+		return false, classifyError(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// NewSession creates a session with a new, randomly generated token and returns
+// the token. The token is generated with crypto/rand and encoded with
+// unpadded URL-safe base64, and the session is created as with CreateNew, so
+// an existing session is never overwritten. In the astronomically unlikely
+// event that the token already exists, another one is generated, up to three
+// attempts in all. NewSession is not supported by stores created with the
+// WithLargeObjectData option.
+func (p *PostgresStore) NewSession(b []byte, expiry time.Time) (token string, err error) {
+	if err := p.checkDB(); err != nil {
+		return "", err
+	}
+
+	n := p.opts.tokenLength
+	if n == 0 {
+		n = defaultTokenLength
+	}
+	for i := 0; i < newSessionAttempts; i++ {
+		token, err = generateToken(n)
+		if err != nil {
+			return "", err
+		}
+		created, err := p.CreateNew(token, b, expiry)
+		if err != nil {
+			return "", err
+		}
+		if created {
+			return token, nil
+		}
+	}
+	return "", fmt.Errorf("postgresstore: could not generate a unique token after %d attempts", newSessionAttempts)
+}
+
+// generateToken returns a token made from n random bytes.
+func generateToken(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Replace overwrites the data and expiry time of an active session, and
+// reports whether it was replaced. Unlike Commit, it never creates a session:
+// if the session doesn't exist or has expired, nothing is written and replaced
+// is false. Replace is not supported by stores created with the
+// WithLargeObjectData option.
+//
+// Replace sets the updated-at column, if there is one, in the same way as
+// Commit.
+func (p *PostgresStore) Replace(token string, b []byte, expiry time.Time) (replaced bool, err error) {
+	return p.ReplaceCtx(context.Background(), token, b, expiry)
+}
+
+// ReplaceCtx is the same as Replace, except it takes a context.Context.
+func (p *PostgresStore) ReplaceCtx(ctx context.Context, token string, b []byte, expiry time.Time) (replaced bool, err error) {
+	if err := p.checkDB(); err != nil {
+		return false, err
+	}
+	defer p.observe("Replace")()
+	if err := p.checkWritable(); err != nil {
+		return false, err
+	}
+	if p.opts.largeObjectData {
+		return false, fmt.Errorf("postgresstore: Replace is not supported with WithLargeObjectData")
+	}
+	if err := p.checkExpiry(expiry); err != nil {
+		return false, err
+	}
+	release, err := p.acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+
+	if p.cache != nil {
+		p.cache.remove(token)
+	}
+
+	columns, values, args := p.commitColumns(token, b, expiry)
+	sets := make([]string, len(columns)-1)
+	for i := range sets {
+		sets[i] = fmt.Sprintf("%s = %s", columns[i+1], values[i+1])
+	}
+	sets[1] = fmt.Sprintf("%s = %s", p.opts.expiryColumnName, p.capExpiry(values[2]))
+	if p.opts.updatedAtColumnName != "" {
+		// The updated-at column follows the data and expiry.
+		switch mode := updatedAtMode(ctx); {
+		case mode == UpdatedAtSuppress:
+			sets = append(sets[:2], sets[3:]...)
+		case mode == UpdatedAtDefault && p.opts.updatedAtOnChange:
+			// As in commitManyQuery, the assignment is moved to the front so
+			// that the comparison sees the stored data.
+			bump := fmt.Sprintf(
+				"%s = CASE WHEN %s IS DISTINCT FROM %s THEN %s ELSE %s END",
+				p.opts.updatedAtColumnName, p.opts.dataColumnName, values[1], values[3], p.opts.updatedAtColumnName,
+			)
+			sets = append([]string{bump, sets[0], sets[1]}, sets[3:]...)
+		}
+	}
+	if p.opts.versionColumnName != "" {
+		sets = append(sets, fmt.Sprintf("%s = %s + 1", p.opts.versionColumnName, p.opts.versionColumnName))
+	}
+
+	res, err := p.q.ExecContext(ctx, fmt.Sprintf(
+		"UPDATE %s SET %s WHERE %s = %s AND %s",
+		p.opts.sessionTableName, strings.Join(sets, ", "), p.opts.tokenColumnName, values[0], p.activePredicate(),
+	), args.values...)
+	if err != nil {
+		return false, classifyError(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// Delete removes a session token and corresponding data from the PostgresStore
+// instance. If the store was created with the WithDeletedAtColumnName option,
+// the session is marked as deleted instead.
+func (p *PostgresStore) Delete(token string) error {
+	return p.DeleteCtx(context.Background(), token)
+}
+
+// DeleteCtx is the same as Delete, except it takes a context.Context.
+func (p *PostgresStore) DeleteCtx(ctx context.Context, token string) error {
+	if err := p.checkDB(); err != nil {
+		return err
+	}
+	defer p.observe("Delete")()
+	if err := p.checkWritable(); err != nil {
+		return err
+	}
+	release, err := p.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if p.cache != nil {
+		p.cache.remove(token)
+	}
+	if p.writes != nil {
+		p.writes.discard(token)
+	}
+
+	err = p.delete(ctx, token)
+	if p.useFallback(err) {
+		return p.opts.fallbackStore.Delete(token)
+	}
+	if err == nil {
+		p.publish(SessionDeleted, token, time.Time{})
+	}
+	return err
+}
+
+func (p *PostgresStore) delete(ctx context.Context, token string) error {
+	_, err := p.q.ExecContext(ctx, p.deleteQuery(), p.tokenArg(token))
+	return classifyError(err)
+}
+
+// DeleteCreatedBefore removes all sessions created before t, whether or not
+// they have expired, and returns the number of sessions removed. This is
+// intended for invalidating every session issued before a security incident.
+// The read cache, if any, is cleared. The store must have been created with
+// the WithCreatedAtColumnName option.
+func (p *PostgresStore) DeleteCreatedBefore(t time.Time) (int, error) {
+	if err := p.checkDB(); err != nil {
+		return 0, err
+	}
+	defer p.observe("DeleteCreatedBefore")()
+	if err := p.checkWritable(); err != nil {
+		return 0, err
+	}
+	if err := p.flushWrites(); err != nil {
+		return 0, err
+	}
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	if p.opts.createdAtColumnName == "" {
+		return 0, notConfigured("WithCreatedAtColumnName")
+	}
+	if p.cache != nil {
+		defer p.cache.clear()
+	}
+
+	args := &queryArgs{dialect: p.opts.dialect}
+	timePlaceholder := args.add(t)
+	if p.opts.largeObjectData {
+		var n int
+		err = p.q.QueryRowContext(context.Background(), fmt.Sprintf(
+			"WITH d AS (DELETE FROM %s WHERE %s < %s%s RETURNING %s) SELECT count(*) FROM d WHERE %s",
+			p.opts.sessionTableName, p.opts.createdAtColumnName, timePlaceholder, p.typeFilter(), p.opts.dataColumnName, p.unlinkCondition(),
+		), args.values...).Scan(&n)
+		if err != nil {
+			return 0, classifyError(err)
+		}
+		return n, nil
+	}
+
+	res, err := p.q.ExecContext(context.Background(), fmt.Sprintf(
+		"DELETE FROM %s WHERE %s < %s%s",
+		p.opts.sessionTableName, p.opts.createdAtColumnName, timePlaceholder, p.typeFilter(),
+	), args.values...)
+	if err != nil {
+		return 0, classifyError(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// CountCreatedBetween returns the number of sessions created at or after start
+// and before end, whether or not they have expired, for charting the rate at
+// which sessions are created. Only sessions which are still in the table are
+// counted, so ranges from before the oldest sessions kept by the cleanup are
+// undercounted. The range is compared directly against the creation time, so
+// an index on the column can be used. The store must have been created with
+// the WithCreatedAtColumnName option.
+func (p *PostgresStore) CountCreatedBetween(start, end time.Time) (int, error) {
+	if err := p.checkDB(); err != nil {
+		return 0, err
+	}
+	defer p.observe("CountCreatedBetween")()
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	if p.opts.createdAtColumnName == "" {
+		return 0, notConfigured("WithCreatedAtColumnName")
+	}
+
+	var n int
+	args := &queryArgs{dialect: p.opts.dialect}
+	startPlaceholder := args.add(start.UTC())
+	endPlaceholder := args.add(end.UTC())
+	err = p.q.QueryRowContext(context.Background(), fmt.Sprintf(
+		"SELECT COUNT(*) FROM %s WHERE %s >= %s AND %s < %s%s",
+		p.opts.sessionTableName, p.opts.createdAtColumnName, startPlaceholder, p.opts.createdAtColumnName, endPlaceholder, p.typeFilter(),
+	), args.values...).Scan(&n)
+	if err != nil {
+		return 0, classifyError(err)
+	}
+	return n, nil
+}
+
+// CountDeletedBetween returns the number of sessions deleted at or after start
+// and before end, for charting the rate at which sessions are ended. Only
+// sessions deleted with Delete are counted, and only until the cleanup removes
+// them once they would have expired. Like CountCreatedBetween, the range is
+// compared directly against the deletion time, so an index on the column can
+// be used. The store must have been created with the WithDeletedAtColumnName
+// option.
+func (p *PostgresStore) CountDeletedBetween(start, end time.Time) (int, error) {
+	if err := p.checkDB(); err != nil {
+		return 0, err
+	}
+	defer p.observe("CountDeletedBetween")()
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	if p.opts.deletedAtColumnName == "" {
+		return 0, notConfigured("WithDeletedAtColumnName")
+	}
+
+	args := &queryArgs{dialect: p.opts.dialect}
+	var n int
+	err = p.q.QueryRowContext(context.Background(), fmt.Sprintf(
+		"SELECT COUNT(*) FROM %s WHERE %s >= %s AND %s < %s%s",
+		p.opts.sessionTableName, p.opts.deletedAtColumnName, args.add(start.UTC()), p.opts.deletedAtColumnName, args.add(end.UTC()), p.typeFilter(),
+	), args.values...).Scan(&n)
+	if err != nil {
+		return 0, classifyError(err)
+	}
+	return n, nil
+}
+
+// DeleteRange removes all sessions whose stored token is greater than or equal
+// to minToken and less than maxToken, whether or not they have expired, and
+// returns the number of sessions removed. An empty maxToken means that there is
+// no upper bound. This lets several workers split maintenance of a large table
+// into non-overlapping token ranges. For stores created with the WithTokenHMAC
+// option the range applies to the stored HMACs, not the tokens. The read cache,
+// if any, is cleared, and the sessions buffered by the WithWriteBehind option
+// are flushed first, so that a buffered commit can't recreate a removed
+// session.
+func (p *PostgresStore) DeleteRange(minToken, maxToken string) (int, error) {
+	if err := p.checkDB(); err != nil {
+		return 0, err
+	}
+	defer p.observe("DeleteRange")()
+	if err := p.checkWritable(); err != nil {
+		return 0, err
+	}
+	if err := p.flushWrites(); err != nil {
+		return 0, err
+	}
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	if p.cache != nil {
+		defer p.cache.clear()
+	}
+
+	args := &queryArgs{dialect: p.opts.dialect}
+	filter := fmt.Sprintf("%s >= %s", p.opts.tokenColumnName, args.add(minToken))
+	if maxToken != "" {
+		filter += fmt.Sprintf(" AND %s < %s", p.opts.tokenColumnName, args.add(maxToken))
+	}
+	filter += p.typeFilter()
+
+	if p.opts.largeObjectData {
+		var n int
+		err = p.q.QueryRowContext(context.Background(), fmt.Sprintf(
+			"WITH d AS (DELETE FROM %s WHERE %s RETURNING %s) SELECT count(*) FROM d WHERE %s",
+			p.opts.sessionTableName, filter, p.opts.dataColumnName, p.unlinkCondition(),
+		), args.values...).Scan(&n)
+		if err != nil {
+			return 0, classifyError(err)
+		}
+		return n, nil
+	}
+
+	res, err := p.q.ExecContext(context.Background(), fmt.Sprintf(
+		"DELETE FROM %s WHERE %s",
+		p.opts.sessionTableName, filter,
+	), args.values...)
+	if err != nil {
+		return 0, classifyError(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// RotateToken atomically moves the data of an active session to a new token
+// with the given expiry time, and deletes the old token. This should be used
+// when the privilege level of a session changes, such as after login, to
+// prevent session fixation attacks. If the old session doesn't exist or has
+// expired, exists is false and nothing is changed. If a session already exists
+// with the new token, an ErrConflict error is returned. The optional columns of
+// the session, such as its subject, lookup attribute, claim and creation time,
+// move to the new token with it.
+func (p *PostgresStore) RotateToken(oldToken, newToken string, expiry time.Time) (exists bool, err error) {
+	if err := p.checkDB(); err != nil {
+		return false, err
+	}
+	defer p.observe("RotateToken")()
+	if err := p.checkWritable(); err != nil {
+		return false, err
+	}
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		return false, err
+	}
+	defer release()
+	if p.cache != nil {
+		p.cache.remove(oldToken)
+		p.cache.remove(newToken)
+	}
+
+	args := &queryArgs{dialect: p.opts.dialect}
+	oldPlaceholder := args.add(p.tokenArg(oldToken))
+	newPlaceholder := args.add(p.tokenArg(newToken))
+	expiryPlaceholder := args.add(expiryValue(expiry))
+	columns := []string{p.opts.tokenColumnName, p.opts.dataColumnName, p.opts.expiryColumnName}
+	values := []string{newPlaceholder, p.opts.dataColumnName, expiryPlaceholder}
+	returning := []string{p.opts.dataColumnName}
+	if p.opts.updatedAtColumnName != "" {
+		columns = append(columns, p.opts.updatedAtColumnName)
+		values = append(values, p.updatedAtExpr())
+	}
+	if p.opts.subjectColumnName != "" {
+		columns = append(columns, p.opts.subjectColumnName)
+		values = append(values, p.opts.subjectColumnName)
+		returning = append(returning, p.opts.subjectColumnName)
+	}
+	if p.opts.lookupColumnName != "" {
+		columns = append(columns, p.opts.lookupColumnName)
+		values = append(values, p.opts.lookupColumnName)
+		returning = append(returning, p.opts.lookupColumnName)
+	}
+	if p.opts.claimColumnName != "" {
+		// A session claimed with TryClaim stays claimed.
+		columns = append(columns, p.opts.claimColumnName)
+		values = append(values, p.opts.claimColumnName)
+		returning = append(returning, p.opts.claimColumnName)
+	}
+	if p.opts.sessionType != "" {
+		columns = append(columns, p.opts.typeColumnName)
+		values = append(values, p.opts.typeColumnName)
+		returning = append(returning, p.opts.typeColumnName)
+	}
+	if p.opts.createdAtColumnName != "" {
+		columns = append(columns, p.opts.createdAtColumnName)
+		values = append(values, p.opts.createdAtColumnName)
+		returning = append(returning, p.opts.createdAtColumnName)
+	}
+	if p.opts.absoluteExpiryColumnName != "" {
+		values[2] = fmt.Sprintf("LEAST(%s::timestamptz, %s)", expiryPlaceholder, p.opts.absoluteExpiryColumnName)
+		columns = append(columns, p.opts.absoluteExpiryColumnName)
+		values = append(values, p.opts.absoluteExpiryColumnName)
+		returning = append(returning, p.opts.absoluteExpiryColumnName)
+	}
+	if p.opts.versionColumnName != "" {
+		columns = append(columns, p.opts.versionColumnName)
+		values = append(values, p.opts.versionColumnName)
+		returning = append(returning, p.opts.versionColumnName)
+	}
+
+	query := fmt.Sprintf(
+		`WITH old AS (DELETE FROM %s WHERE %s = %s AND %s RETURNING %s)
+		INSERT INTO %s (%s) SELECT %s FROM old`,
+		p.opts.sessionTableName, p.opts.tokenColumnName, oldPlaceholder, p.activePredicate(), strings.Join(returning, ", "),
+		p.opts.sessionTableName, strings.Join(columns, ", "), strings.Join(values, ", "),
+	)
+
+	// A commit of the old token which is still buffered is written first, so
+	// that its latest data moves to the new token and the flusher can't
+	// recreate the old session afterwards. If the rotation fails, the commit
+	// goes back in the buffer.
+	var (
+		pending  pendingWrite
+		buffered bool
+	)
+	if p.writes != nil {
+		pending, buffered = p.writes.pop(oldToken)
+	}
+	err = p.writeTx(context.Background(), func(view *PostgresStore) error {
+		if buffered {
+			_, err := view.commit(context.Background(), oldToken, pending.data, pending.expiry)
+			if err != nil {
+				return err
+			}
+		}
+		res, err := view.q.ExecContext(context.Background(), query, args.values...)
+		if err != nil {
+			return classifyError(err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		exists = n > 0
+		return nil
+	})
+	if err != nil {
+		if buffered && !p.writes.restore(pending) {
+			if _, err := p.commit(context.Background(), oldToken, pending.data, pending.expiry); err != nil {
+				log.Println(err)
+			}
+		}
+		return false, err
+	}
+	return exists, nil
+}
+
+// Touch updates the expiry time of an active session, without rewriting its
+// data. If the session doesn't exist or has expired, ErrNotFound is returned.
+// A zero expiry time means that the session never expires.
+func (p *PostgresStore) Touch(token string, expiry time.Time) error {
+	if err := p.checkDB(); err != nil {
+		return err
+	}
+	defer p.observe("Touch")()
+	if err := p.checkWritable(); err != nil {
+		return err
+	}
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		return err
+	}
+	defer release()
+	if p.cache != nil {
+		p.cache.remove(token)
+	}
+
+	args := &queryArgs{dialect: p.opts.dialect}
+	tokenPlaceholder := args.add(p.tokenArg(token))
+	expiryPlaceholder := args.add(expiryValue(expiry))
+	res, err := p.q.ExecContext(context.Background(), fmt.Sprintf(
+		"UPDATE %s SET %s = %s WHERE %s = %s AND %s",
+		p.opts.sessionTableName, p.opts.expiryColumnName, p.capExpiry(expiryPlaceholder), p.opts.tokenColumnName, tokenPlaceholder, p.activePredicate(),
+	), args.values...)
+	if err != nil {
+		return classifyError(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// commitManyBatch is the largest number of sessions which CommitMany writes
+// in one statement, which keeps the number of arguments well below
+// PostgreSQL's limit of 65535.
+const commitManyBatch = 1000
+
+// CommitMany adds or replaces the sessions with the given tokens, data and
+// expiry times, which are parallel slices, so that each session can have its
+// own expiry time. It returns the tokens of the sessions which were created
+// rather than replaced. The sessions are written in statements of up to 1000
+// sessions each, rather than one at a time. If a token is repeated, the last
+// of its entries is written. Sessions which aren't written because of the
+// WithConditionalUpdate option are in neither group. CommitMany uses
+// PostgreSQL syntax regardless of the dialect, bypasses the WithWriteBehind
+// buffer and doesn't make expiry-only updates. It is not supported by stores
+// created with the WithLargeObjectData option.
+func (p *PostgresStore) CommitMany(tokens []string, data [][]byte, expiries []time.Time) (created []string, err error) {
+	if err := p.checkDB(); err != nil {
+		return nil, err
+	}
+	defer p.observe("CommitMany")()
+	if err := p.checkWritable(); err != nil {
+		return nil, err
+	}
+	if p.opts.largeObjectData {
+		return nil, fmt.Errorf("postgresstore: CommitMany is not supported with WithLargeObjectData")
+	}
+	if len(data) != len(tokens) || len(expiries) != len(tokens) {
+		return nil, fmt.Errorf("postgresstore: CommitMany got %d tokens, %d data and %d expiries", len(tokens), len(data), len(expiries))
+	}
+	for _, expiry := range expiries {
+		if err := p.checkExpiry(expiry); err != nil {
+			return nil, err
+		}
+	}
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// An upsert can't change the same row twice, so only the last entry for
+	// each token is kept.
+	last := make(map[string]int, len(tokens))
+	for i, token := range tokens {
+		last[token] = i
+	}
+	writes := make([]pendingWrite, 0, len(last))
+	for i, token := range tokens {
+		if last[token] != i {
+			continue
+		}
+		if p.cache != nil {
+			p.cache.remove(token)
+		}
+		if p.writes != nil {
+			p.writes.discard(token)
+		}
+		writes = append(writes, pendingWrite{token: token, data: data[i], expiry: expiries[i]})
+	}
+
+	err = p.writeTx(context.Background(), func(view *PostgresStore) error {
+		created = nil
+		for start := 0; start < len(writes); start += commitManyBatch {
+			end := start + commitManyBatch
+			if end > len(writes) {
+				end = len(writes)
+			}
+			err := view.writeRows(context.Background(), writes[start:end], &created)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// writeRows writes writes, which must not be empty or repeat a token, with a
+// single upsert. If created isn't nil, the tokens of the sessions which were
+// created rather than replaced are appended to it. If created isn't nil or the
+// store has an event sink, the statement reports which sessions were created,
+// so that the right event is published for each.
+func (p *PostgresStore) writeRows(ctx context.Context, writes []pendingWrite, created *[]string) error {
+	query, args := p.commitManyQuery(writes)
+	if created == nil && p.opts.eventSink == nil {
+		_, err := p.q.ExecContext(ctx, query, args...)
+		return classifyError(err)
+	}
+
+	// The tokens read back are mapped to the ones which were passed in, as
+	// they may be stored as HMACs.
+	byStored := make(map[string]pendingWrite, len(writes))
+	for _, w := range writes {
+		byStored[p.storedToken(w.token)] = w
+	}
+	rows, err := p.q.QueryContext(ctx, fmt.Sprintf("%s RETURNING %s, (xmax = 0)", query, p.opts.tokenColumnName), args...)
+	if err != nil {
+		return classifyError(err)
+	}
+	if created == nil {
+		created = new([]string)
+	}
+	return p.commitManyRows(rows, byStored, created)
+}
+
+// commitManyRows reads the rows returned by a statement of CommitMany,
+// appending the tokens of the created sessions to created and publishing an
+// event for each written session.
+func (p *PostgresStore) commitManyRows(rows *sql.Rows, byStored map[string]pendingWrite, created *[]string) error {
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			stored    string
+			isCreated bool
+		)
+		err := rows.Scan(&stored, &isCreated)
+		if err != nil {
+			return classifyError(err)
+		}
+		w := byStored[stored]
+		if isCreated {
+			*created = append(*created, w.token)
+			p.publish(SessionCreated, w.token, w.expiry)
+		} else {
+			p.publish(SessionRefreshed, w.token, w.expiry)
+		}
+	}
+	return classifyError(rows.Err())
+}
+
+// TouchMany updates the expiry time of each of the given sessions in a single
+// statement. Sessions which don't exist or have expired are ignored.
+func (p *PostgresStore) TouchMany(tokens []string, expiry time.Time) error {
+	if err := p.checkDB(); err != nil {
+		return err
+	}
+	defer p.observe("TouchMany")()
+	if err := p.checkWritable(); err != nil {
+		return err
+	}
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		return err
+	}
+	defer release()
+	if p.cache != nil {
+		for _, token := range tokens {
+			p.cache.remove(token)
+		}
+	}
+
+	args := &queryArgs{dialect: p.opts.dialect}
+	tokensPlaceholder := args.add(pq.Array(p.storedTokens(tokens)))
+	expiryPlaceholder := args.add(expiryValue(expiry))
+	_, err = p.q.ExecContext(context.Background(), fmt.Sprintf(
+		"UPDATE %s SET %s = %s WHERE %s = ANY(%s) AND %s",
+		p.opts.sessionTableName, p.opts.expiryColumnName, p.capExpiry(expiryPlaceholder), p.opts.tokenColumnName, tokensPlaceholder, p.activePredicate(),
+	), args.values...)
+	return classifyError(err)
+}
+
+// TouchManyExpiries is the same as TouchMany, except each session is given its
+// own expiry time. The map key is the session token and the map value is the
+// new expiry time.
+func (p *PostgresStore) TouchManyExpiries(expiries map[string]time.Time) error {
+	if err := p.checkDB(); err != nil {
+		return err
+	}
+	defer p.observe("TouchManyExpiries")()
+	if err := p.checkWritable(); err != nil {
+		return err
+	}
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	tokens := make([]string, 0, len(expiries))
+	times := make([]string, 0, len(expiries))
+	for token, expiry := range expiries {
+		if p.cache != nil {
+			p.cache.remove(token)
+		}
+		tokens = append(tokens, p.storedToken(token))
+		if expiry.IsZero() {
+			times = append(times, "")
+		} else {
+			times = append(times, expiry.Format(time.RFC3339Nano))
+		}
+	}
+
+	// The tokens are compared with ANY and looked up with array_position,
+	// so that PostgreSQL casts the array to the type of the token column.
+	args := &queryArgs{dialect: p.opts.dialect}
+	tokensPlaceholder := args.add(pq.Array(tokens))
+	expiry := fmt.Sprintf(
+		"NULLIF((%s::text[])[array_position(%s, %s)], '')::timestamptz",
+		args.add(pq.Array(times)), tokensPlaceholder, p.opts.tokenColumnName,
+	)
+	_, err = p.q.ExecContext(context.Background(), fmt.Sprintf(
+		"UPDATE %s SET %s = %s WHERE %s = ANY(%s) AND %s",
+		p.opts.sessionTableName, p.opts.expiryColumnName, p.capExpiry(expiry),
+		p.opts.tokenColumnName, tokensPlaceholder, p.activePredicate(),
+	), args.values...)
+	return classifyError(err)
+}
+
+// TouchBySubject updates the expiry time of all of the active sessions for a
+// subject, and returns the number of sessions updated. Sessions which have
+// already expired are not extended. A zero expiry time means that the sessions
+// never expire. The store must have been created with the WithSubjectColumn
+// option.
+func (p *PostgresStore) TouchBySubject(subject string, expiry time.Time) (int, error) {
+	if err := p.checkDB(); err != nil {
+		return 0, err
+	}
+	defer p.observe("TouchBySubject")()
+	if err := p.checkWritable(); err != nil {
+		return 0, err
+	}
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	if p.opts.subjectColumnName == "" {
+		return 0, notConfigured("WithSubjectColumn")
+	}
+
+	args := &queryArgs{dialect: p.opts.dialect}
+	subjectPlaceholder := args.add(subject)
+	expiryPlaceholder := args.add(expiryValue(expiry))
+	res, err := p.q.ExecContext(context.Background(), fmt.Sprintf(
+		"UPDATE %s SET %s = %s WHERE %s = %s AND %s",
+		p.opts.sessionTableName, p.opts.expiryColumnName, p.capExpiry(expiryPlaceholder), p.opts.subjectColumnName, subjectPlaceholder, p.activePredicate(),
+	), args.values...)
+	if err != nil {
+		return 0, classifyError(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// DeleteOtherSessions removes all of the sessions for a subject except the one
+// with keepToken, whether or not they have expired, and returns the number of
+// sessions removed. This is intended for logging a user out of their other
+// devices in a single statement. The read cache, if any, is cleared, and the
+// sessions buffered by the WithWriteBehind option are flushed first, so that a
+// buffered commit can't recreate a removed session. The store must have been
+// created with the WithSubjectColumn option.
+func (p *PostgresStore) DeleteOtherSessions(subject, keepToken string) (int, error) {
+	if err := p.checkDB(); err != nil {
+		return 0, err
+	}
+	defer p.observe("DeleteOtherSessions")()
+	if err := p.checkWritable(); err != nil {
+		return 0, err
+	}
+	if err := p.flushWrites(); err != nil {
+		return 0, err
+	}
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	if p.opts.subjectColumnName == "" {
+		return 0, notConfigured("WithSubjectColumn")
+	}
+	if p.cache != nil {
+		defer p.cache.clear()
+	}
+
+	args := &queryArgs{dialect: p.opts.dialect}
+	subjectPlaceholder := args.add(subject)
+	keepPlaceholder := args.add(p.tokenArg(keepToken))
+	if p.opts.largeObjectData {
+		var n int
+		err = p.q.QueryRowContext(context.Background(), fmt.Sprintf(
+			"WITH d AS (DELETE FROM %s WHERE %s = %s AND %s <> %s%s RETURNING %s) SELECT count(*) FROM d WHERE %s",
+			p.opts.sessionTableName, p.opts.subjectColumnName, subjectPlaceholder, p.opts.tokenColumnName, keepPlaceholder, p.typeFilter(), p.opts.dataColumnName, p.unlinkCondition(),
+		), args.values...).Scan(&n)
+		if err != nil {
+			return 0, classifyError(err)
+		}
+		return n, nil
+	}
+
+	res, err := p.q.ExecContext(context.Background(), fmt.Sprintf(
+		"DELETE FROM %s WHERE %s = %s AND %s <> %s%s",
+		p.opts.sessionTableName, p.opts.subjectColumnName, subjectPlaceholder, p.opts.tokenColumnName, keepPlaceholder, p.typeFilter(),
+	), args.values...)
+	if err != nil {
+		return 0, classifyError(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// UpdateField sets the value at path within the JSON data of an active session,
+// without rewriting the rest of the data. The path is a dot-separated list of
+// object keys or array indexes, such as "user.roles.0". If the session doesn't
+// exist or has expired, ErrNotFound is returned. The store must have been
+// created with the WithJSONB option.
+func (p *PostgresStore) UpdateField(token string, path string, value json.RawMessage) error {
+	if err := p.checkDB(); err != nil {
+		return err
+	}
+	defer p.observe("UpdateField")()
+	if err := p.checkWritable(); err != nil {
+		return err
+	}
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		return err
+	}
+	defer release()
+	if !p.opts.jsonb {
+		return notConfigured("WithJSONB")
+	}
+
+	keys := strings.Split(path, ".")
+	for _, key := range keys {
+		if key == "" {
+			return fmt.Errorf("postgresstore: invalid path %q", path)
+		}
+	}
+	if !json.Valid(value) {
+		return fmt.Errorf("postgresstore: invalid JSON value for path %q", path)
+	}
+
+	if p.cache != nil {
+		p.cache.remove(token)
+	}
+
+	args := &queryArgs{dialect: p.opts.dialect}
+	set := fmt.Sprintf("%s = jsonb_set(%s, %s, %s::jsonb)", p.opts.dataColumnName, p.opts.dataColumnName, args.add(pq.Array(keys)), args.add(string(value)))
+	if p.opts.versionColumnName != "" {
+		set += fmt.Sprintf(", %s = %s + 1", p.opts.versionColumnName, p.opts.versionColumnName)
+	}
+	tokenPlaceholder := args.add(p.tokenArg(token))
+	res, err := p.q.ExecContext(context.Background(), fmt.Sprintf(
+		"UPDATE %s SET %s WHERE %s = %s AND %s",
+		p.opts.sessionTableName, set, p.opts.tokenColumnName, tokenPlaceholder, p.activePredicate(),
+	), args.values...)
+	if err != nil {
+		return classifyError(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// All returns a map containing the token and data for all active (i.e.
+// not expired) sessions in the PostgresStore instance.
+func (p *PostgresStore) All() (map[string][]byte, error) {
+	return p.AllCtx(context.Background())
+}
+
+// AllCtx is the same as All, except it takes a context.Context.
+func (p *PostgresStore) AllCtx(ctx context.Context) (map[string][]byte, error) {
+	sessions := make(map[string][]byte)
+
+	err := p.AllFunc(ctx, func(token string, data []byte) error {
+		sessions[token] = data
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// AllFunc calls fn with the token and data of each active session in the
+// PostgresStore instance, streaming the rows from the database rather than
+// loading them all into memory. If fn returns an error, iteration stops and
+// that error is returned. The context is checked between rows, so cancelling
+// it stops both the query and the iteration promptly.
+func (p *PostgresStore) AllFunc(ctx context.Context, fn func(token string, data []byte) error) error {
+	if err := p.checkDB(); err != nil {
+		return err
+	}
+	defer p.observe("All")()
+	release, err := p.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return p.allFunc(ctx, "", nil, fn)
+}
+
+// AllSlice returns the token, data and expiry time of all active sessions, in
+// the same way as All, as a slice ordered by token. If there are no active
+// sessions, an empty slice is returned. When tokens are stored as HMACs, the
+// Token of each session is the stored HMAC.
+func (p *PostgresStore) AllSlice() ([]SessionInfo, error) {
+	if err := p.checkDB(); err != nil {
+		return nil, err
+	}
+	defer p.observe("AllSlice")()
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return p.allSlice(" WHERE "+p.activePredicate(), p.opts.allRowLimit)
+}
+
+// AllIncludingExpired is the same as AllSlice, except that it also returns
+// the sessions which have expired but haven't been removed by the cleanup yet.
+// It is intended for inspecting the table during incident investigations, and
+// must not be used to authenticate requests.
+func (p *PostgresStore) AllIncludingExpired() ([]SessionInfo, error) {
+	if err := p.checkDB(); err != nil {
+		return nil, err
+	}
+	defer p.observe("AllIncludingExpired")()
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	where := ""
+	if p.opts.sessionType != "" {
+		where = " WHERE " + p.typeCondition()
+	}
+	return p.allSlice(where, p.opts.allRowLimit)
+}
+
+// rowLimitClause returns the LIMIT clause for a query which should fail with
+// ErrTooManyRows if there are more than limit rows, reading one more row than
+// the limit so that exceeding it can be detected. It is empty if limit is
+// zero.
+func rowLimitClause(limit int) string {
+	if limit <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(" LIMIT %d", limit+1)
+}
+
+// allSlice returns the sessions matching where, an SQL WHERE clause which is
+// empty or starts with a space and uses args as its parameters, ordered by
+// token. If there are more than limit sessions, ErrTooManyRows is returned; a
+// zero limit means that there is no limit.
+func (p *PostgresStore) allSlice(where string, limit int, args ...interface{}) ([]SessionInfo, error) {
+	rows, err := p.q.QueryContext(context.Background(), fmt.Sprintf(
+		"SELECT %s, %s, %s FROM %s%s ORDER BY %s%s",
+		p.opts.tokenColumnName, p.dataExpr(), p.opts.expiryColumnName, p.opts.sessionTableName, where, p.opts.tokenColumnName, rowLimitClause(limit),
+	), args...)
+	if err != nil {
+		return nil, classifyError(err)
+	}
+	defer rows.Close()
+
+	sessions := []SessionInfo{}
+
+	for rows.Next() {
+		if limit > 0 && len(sessions) == limit {
+			return nil, ErrTooManyRows
+		}
+
+		var (
+			info   SessionInfo
+			expiry sql.NullTime
+		)
+		err = rows.Scan(&info.Token, &info.Data, &expiry)
+		if err != nil {
+			return nil, classifyError(err)
+		}
+		info.Expiry = expiry.Time
+		sessions = append(sessions, info)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, classifyError(err)
+	}
+
+	return sessions, nil
+}
+
+// AllForSubject returns a map containing the token and data for the active
+// sessions of a subject, in the same way as All. If the subject has no active
+// sessions, an empty map is returned. The store must have been created with
+// the WithSubjectColumn option.
+func (p *PostgresStore) AllForSubject(subject string) (map[string][]byte, error) {
+	if err := p.checkDB(); err != nil {
+		return nil, err
+	}
+	defer p.observe("AllForSubject")()
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if p.opts.subjectColumnName == "" {
+		return nil, notConfigured("WithSubjectColumn")
+	}
+
+	sessions := make(map[string][]byte)
+
+	args := &queryArgs{dialect: p.opts.dialect}
+	filter := fmt.Sprintf("%s = %s", p.opts.subjectColumnName, args.add(subject))
+	err = p.allFunc(context.Background(), filter, args.values, func(token string, data []byte) error {
+		sessions[token] = data
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// allFunc calls fn with the token and data of each active session which also
+// matches filter, an SQL predicate using args as its parameters, or of every
+// active session if filter is empty.
+func (p *PostgresStore) allFunc(ctx context.Context, filter string, args []interface{}, fn func(token string, data []byte) error) error {
+	where := p.activePredicate()
+	if filter != "" {
+		where = filter + " AND " + where
+	}
+
+	rows, err := p.q.QueryContext(ctx, fmt.Sprintf(
+		"SELECT %s, %s FROM %s WHERE %s%s",
+		p.opts.tokenColumnName, p.dataExpr(), p.opts.sessionTableName, where, rowLimitClause(p.opts.allRowLimit),
+	), args...)
+	if err != nil {
+		return classifyError(err)
+	}
+	defer rows.Close()
+
+	var n int
+	for rows.Next() {
+		err = ctx.Err()
+		if err != nil {
+			return classifyError(err)
+		}
+		if p.opts.allRowLimit > 0 && n == p.opts.allRowLimit {
+			return ErrTooManyRows
+		}
+		n++
+
+		var (
+			token string
+			data  []byte
+		)
+
+		err = rows.Scan(&token, &data)
+		if err != nil {
+			return classifyError(err)
+		}
+
+		err = fn(token, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return classifyError(rows.Err())
+}
+
+// WriteAllJSON writes the active sessions to w as a JSON array, encoding each
+// session as it is read from the database so that they aren't all held in
+// memory at once. Each element is an object with "token" and "data" fields.
+// The data is base64-encoded, as with json.Marshal, unless the store was
+// created with the WithJSONB option, in which case it is included as JSON. If
+// there are no active sessions, an empty array is written. If an error is
+// returned, the output may be incomplete.
+func (p *PostgresStore) WriteAllJSON(ctx context.Context, w io.Writer) error {
+	type jsonSession struct {
+		Token string      `json:"token"`
+		Data  interface{} `json:"data"`
+	}
+
+	_, err := io.WriteString(w, "[")
+	if err != nil {
+		return err
+	}
+
+	sep := ""
+	err = p.AllFunc(ctx, func(token string, data []byte) error {
+		session := jsonSession{Token: token, Data: data}
+		if p.opts.jsonb {
+			session.Data = json.RawMessage(data)
+		}
+		b, err := json.Marshal(session)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, sep)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		sep = ","
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, "]")
+	return err
+}
+
+// AllBatched returns a map containing the token and data for all active
+// sessions, in the same way as All, but reads them in batches of at most
+// batchSize sessions ordered by token. The connection is returned to the pool
+// between batches, so that a large table doesn't hold one connection for the
+// whole read. Sessions inserted or deleted while the batches are being read
+// may or may not be included.
+func (p *PostgresStore) AllBatched(batchSize int) (map[string][]byte, error) {
+	if err := p.checkDB(); err != nil {
+		return nil, err
+	}
+	defer p.observe("AllBatched")()
+	if batchSize <= 0 {
+		return nil, fmt.Errorf("postgresstore: invalid batch size %d", batchSize)
+	}
+
+	sessions := make(map[string][]byte)
+	var lastToken *string
+	for {
+		n, err := p.allBatch(context.Background(), lastToken, batchSize, func(info SessionInfo) {
+			sessions[info.Token] = info.Data
+			lastToken = &info.Token
+		})
+		if err != nil {
+			return nil, err
+		}
+		if n < batchSize {
+			return sessions, nil
+		}
+	}
+}
+
+// allBatch calls fn with up to limit active sessions, in token order, whose
+// tokens are after lastToken, or from the start if lastToken is nil. It
+// returns the number of sessions read.
+func (p *PostgresStore) allBatch(ctx context.Context, lastToken *string, limit int, fn func(info SessionInfo)) (int, error) {
+	release, err := p.acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	args := &queryArgs{dialect: p.opts.dialect}
+	where := p.activePredicate()
+	if lastToken != nil {
+		where = fmt.Sprintf("%s > %s AND %s", p.opts.tokenColumnName, args.add(*lastToken), where)
+	}
+
+	rows, err := p.q.QueryContext(ctx, fmt.Sprintf(
+		"SELECT %s, %s, %s FROM %s WHERE %s ORDER BY %s LIMIT %s",
+		p.opts.tokenColumnName, p.dataExpr(), p.opts.expiryColumnName, p.opts.sessionTableName, where, p.opts.tokenColumnName, args.add(limit),
+	), args.values...)
+	if err != nil {
+		return 0, classifyError(err)
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		var (
+			info   SessionInfo
+			expiry sql.NullTime
+		)
+		err = rows.Scan(&info.Token, &info.Data, &expiry)
+		if err != nil {
+			return 0, classifyError(err)
+		}
+		info.Expiry = expiry.Time
+		fn(info)
+		n++
+	}
+	return n, classifyError(rows.Err())
+}
+
+// ChangedSince returns a map containing the token and data for all active
+// sessions which have been committed at or after the given time. It can be
+// used to incrementally copy sessions to another datastore, using LastUpdated
+// to find the time to pass on the next call. The check is inclusive, so the
+// sessions committed at the checkpoint itself are returned again rather than
+// missed. A session's updated-at time is taken when it is written, but it is
+// only visible once its transaction commits, so a session can appear with a
+// time earlier than a checkpoint read in the meantime; subtract an overlap
+// longer than the longest write transaction from the checkpoint to be sure of
+// seeing it. The store must have been created with the WithUpdatedAtColumnName
+// option.
+func (p *PostgresStore) ChangedSince(t time.Time) (map[string][]byte, error) {
+	if err := p.checkDB(); err != nil {
+		return nil, err
+	}
+	defer p.observe("ChangedSince")()
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if p.opts.updatedAtColumnName == "" {
+		return nil, notConfigured("WithUpdatedAtColumnName")
+	}
+
+	args := &queryArgs{dialect: p.opts.dialect}
+	timePlaceholder := args.add(t)
+	rows, err := p.q.QueryContext(context.Background(), fmt.Sprintf(
+		"SELECT %s, %s FROM %s WHERE %s >= %s AND %s",
+		p.opts.tokenColumnName, p.dataExpr(), p.opts.sessionTableName, p.opts.updatedAtColumnName, timePlaceholder, p.activePredicate(),
+	), args.values...)
+	if err != nil {
+		return nil, classifyError(err)
+	}
+	defer rows.Close()
+
+	sessions := make(map[string][]byte)
+
+	for rows.Next() {
+		var (
+			token string
+			data  []byte
+		)
+
+		err = rows.Scan(&token, &data)
+		if err != nil {
+			return nil, classifyError(err)
+		}
+
+		sessions[token] = data
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, classifyError(err)
+	}
+
+	return sessions, nil
+}
+
+// LastUpdated returns the most recent time that any active session was
+// committed, or the zero time if there are no active sessions. The store must
+// have been created with the WithUpdatedAtColumnName option.
+func (p *PostgresStore) LastUpdated() (time.Time, error) {
+	if err := p.checkDB(); err != nil {
+		return time.Time{}, err
+	}
+	defer p.observe("LastUpdated")()
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer release()
+	if p.opts.updatedAtColumnName == "" {
+		return time.Time{}, notConfigured("WithUpdatedAtColumnName")
+	}
+
+	var t sql.NullTime
+	err = p.q.QueryRowContext(context.Background(), fmt.Sprintf(
+		"SELECT MAX(%s) FROM %s WHERE %s",
+		p.opts.updatedAtColumnName, p.opts.sessionTableName, p.activePredicate(),
+	)).Scan(&t)
+	if err != nil {
+		return time.Time{}, classifyError(err)
+	}
+	return t.Time, nil
+}
+
+// ActiveSubjects returns the distinct subjects which have at least one active
+// session. If there are no active sessions, an empty slice is returned. The
+// store must have been created with the WithSubjectColumn option.
+func (p *PostgresStore) ActiveSubjects() ([]string, error) {
+	if err := p.checkDB(); err != nil {
+		return nil, err
+	}
+	defer p.observe("ActiveSubjects")()
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if p.opts.subjectColumnName == "" {
+		return nil, notConfigured("WithSubjectColumn")
+	}
+
+	rows, err := p.q.QueryContext(context.Background(), fmt.Sprintf(
+		"SELECT DISTINCT %s FROM %s WHERE %s IS NOT NULL AND %s",
+		p.opts.subjectColumnName, p.opts.sessionTableName, p.opts.subjectColumnName, p.activePredicate(),
+	))
+	if err != nil {
+		return nil, classifyError(err)
+	}
+	defer rows.Close()
+
+	subjects := []string{}
+
+	for rows.Next() {
+		var subject string
+		err = rows.Scan(&subject)
+		if err != nil {
+			return nil, classifyError(err)
+		}
+		subjects = append(subjects, subject)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, classifyError(err)
+	}
+
+	return subjects, nil
+}
+
+// FindByAttribute returns the active sessions whose lookup column, set with
+// the WithLookupColumn option, equals value, ordered by token. As the value
+// needn't be unique, there may be any number of them; if there are none, an
+// empty slice is returned. When tokens are stored as HMACs, the Token of each
+// session is the stored HMAC.
+func (p *PostgresStore) FindByAttribute(value string) ([]SessionInfo, error) {
+	if err := p.checkDB(); err != nil {
+		return nil, err
+	}
+	defer p.observe("FindByAttribute")()
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if p.opts.lookupColumnName == "" {
+		return nil, notConfigured("WithLookupColumn")
+	}
+
+	args := &queryArgs{dialect: p.opts.dialect}
+	where := fmt.Sprintf(" WHERE %s = %s AND %s", p.opts.lookupColumnName, args.add(value), p.activePredicate())
+	return p.allSlice(where, 0, args.values...)
+}
+
+// TryClaim claims the session for token until ttl from now, if it isn't
+// already claimed, so that only one worker processes it at a time. It returns
+// true if this call won the claim, and false if the session is claimed by
+// someone else, doesn't exist or has expired. A claim lapses when its ttl has
+// passed, or when it's released with Release. The store must have been
+// created with the WithClaimColumn option.
+func (p *PostgresStore) TryClaim(token string, ttl time.Duration) (claimed bool, err error) {
+	if err := p.checkDB(); err != nil {
+		return false, err
+	}
+	defer p.observe("TryClaim")()
+	if err := p.checkWritable(); err != nil {
+		return false, err
+	}
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		return false, err
+	}
+	defer release()
+	if p.opts.claimColumnName == "" {
+		return false, notConfigured("WithClaimColumn")
+	}
+
+	// The claim is checked in the UPDATE itself, which PostgreSQL re-evaluates
+	// after waiting for a concurrent claim, so only one caller can win.
+	now := p.nowExpr()
+	args := &queryArgs{dialect: p.opts.dialect}
+	tokenPlaceholder := args.add(p.tokenArg(token))
+	err = p.q.QueryRowContext(context.Background(), fmt.Sprintf(
+		"UPDATE %s SET %s = %s + interval '1 second' * %s::float8 WHERE %s = %s AND %s AND (%s IS NULL OR %s <= %s) RETURNING true",
+		p.opts.sessionTableName, p.opts.claimColumnName, now, args.add(ttl.Seconds()), p.opts.tokenColumnName, tokenPlaceholder, p.activePredicate(),
+		p.opts.claimColumnName, p.opts.claimColumnName, now,
+	), args.values...).Scan(&claimed)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, classifyError(err)
+	}
+	return claimed, nil
+}
+
+// Release clears the claim on the session for token made by TryClaim, so that
+// it can be claimed again straight away. It doesn't check who made the claim,
+// and releasing a session which isn't claimed or doesn't exist does nothing.
+// The store must have been created with the WithClaimColumn option.
+func (p *PostgresStore) Release(token string) error {
+	if err := p.checkDB(); err != nil {
+		return err
+	}
+	defer p.observe("Release")()
+	if err := p.checkWritable(); err != nil {
+		return err
+	}
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		return err
+	}
+	defer release()
+	if p.opts.claimColumnName == "" {
+		return notConfigured("WithClaimColumn")
+	}
+
+	args := &queryArgs{dialect: p.opts.dialect}
+	tokenPlaceholder := args.add(p.tokenArg(token))
+	_, err = p.q.ExecContext(context.Background(), fmt.Sprintf(
+		"UPDATE %s SET %s = NULL WHERE %s = %s%s",
+		p.opts.sessionTableName, p.opts.claimColumnName, p.opts.tokenColumnName, tokenPlaceholder, p.typeFilter(),
+	), args.values...)
+	return classifyError(err)
+}
+
+// SiblingSessions returns the active sessions which share a subject with the
+// session for token, including that session itself, which is marked as
+// Current. If the session doesn't exist, has expired or has no subject, an
+// empty slice is returned. The store must have been created with the
+// WithSubjectColumn option. When tokens are stored as HMACs, the Token of each
+// session other than the current one is the stored HMAC.
+func (p *PostgresStore) SiblingSessions(token string) ([]SessionInfo, error) {
+	if err := p.checkDB(); err != nil {
+		return nil, err
+	}
+	defer p.observe("SiblingSessions")()
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if p.opts.subjectColumnName == "" {
+		return nil, notConfigured("WithSubjectColumn")
+	}
+
+	stored := p.storedToken(token)
+	args := &queryArgs{dialect: p.opts.dialect}
+	tokenPlaceholder := args.add(p.tokenArg(token))
+	rows, err := p.q.QueryContext(context.Background(), fmt.Sprintf(
+		"SELECT %s, %s, %s FROM %s WHERE %s = (SELECT %s FROM %s WHERE %s = %s AND %s) AND %s ORDER BY %s",
+		p.opts.tokenColumnName, p.dataExpr(), p.opts.expiryColumnName, p.opts.sessionTableName,
+		p.opts.subjectColumnName, p.opts.subjectColumnName, p.opts.sessionTableName, p.opts.tokenColumnName, tokenPlaceholder, p.activePredicate(),
+		p.activePredicate(), p.opts.tokenColumnName,
+	), args.values...)
+	if err != nil {
+		return nil, classifyError(err)
+	}
+	defer rows.Close()
+
+	sessions := []SessionInfo{}
+
+	for rows.Next() {
+		var (
+			info   SessionInfo
+			expiry sql.NullTime
+		)
+		err = rows.Scan(&info.Token, &info.Data, &expiry)
+		if err != nil {
+			return nil, classifyError(err)
+		}
+		info.Expiry = expiry.Time
+		if info.Token == stored {
+			info.Token = token
+			info.Current = true
+		}
+		sessions = append(sessions, info)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, classifyError(err)
+	}
+
+	return sessions, nil
+}
+
+// TableStats returns the approximate number of rows in the sessions table and
+// its total size on disk in bytes, including indexes and TOAST data. The row
+// count is the planner's estimate from pg_class.reltuples and, unlike
+// COUNT(*), includes expired sessions which have not been cleaned up yet. It is
+// cheap to run even against very large tables, but is only as accurate as the
+// table's most recent VACUUM or ANALYZE.
+func (p *PostgresStore) TableStats() (approxRows int64, sizeBytes int64, err error) {
+	if err := p.checkDB(); err != nil {
+		return 0, 0, err
+	}
+	defer p.observe("TableStats")()
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		return 0, 0, err
+	}
+	defer release()
+
+	row := p.q.QueryRowContext(context.Background(),
+		"SELECT GREATEST(reltuples, 0)::bigint, pg_total_relation_size(oid) FROM pg_class WHERE oid = $1::regclass",
+		p.opts.sessionTableName,
+	)
+	err = row.Scan(&approxRows, &sizeBytes)
+	if err != nil {
+		return 0, 0, classifyError(err)
+	}
+	return approxRows, sizeBytes, nil
+}
+
+// ExpiryRange returns the earliest and latest expiry times of the active
+// sessions, from a single aggregate query. Sessions which never expire are
+// ignored. If there are no active sessions with an expiry time, zero times are
+// returned and the exists flag is false.
+func (p *PostgresStore) ExpiryRange() (oldest, newest time.Time, exists bool, err error) {
+	if err := p.checkDB(); err != nil {
+		return time.Time{}, time.Time{}, false, err
+	}
+	defer p.observe("ExpiryRange")()
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		return time.Time{}, time.Time{}, false, err
+	}
+	defer release()
+
+	var min, max sql.NullTime
+	err = p.q.QueryRowContext(context.Background(), fmt.Sprintf(
+		"SELECT MIN(%s), MAX(%s) FROM %s WHERE %s",
+		p.opts.expiryColumnName, p.opts.expiryColumnName, p.opts.sessionTableName, p.activePredicate(),
+	)).Scan(&min, &max)
+	if err != nil {
+		return time.Time{}, time.Time{}, false, classifyError(err)
+	}
+	if !min.Valid {
+		return time.Time{}, time.Time{}, false, nil
+	}
+	return min.Time, max.Time, true, nil
+}
+
+// QueryActive runs a SELECT over the active sessions, for ad hoc analytics
+// which shouldn't need to know the store's table name or how it decides that a
+// session is active. The query is
+//
+//	SELECT <selectList> FROM <table> WHERE <active predicate> <clauses>
+//
+// so clauses can narrow the selection with AND and add GROUP BY, ORDER BY or
+// LIMIT clauses, referring to args as $1, $2 and so on. selectList and clauses
+// are included in the query as they are, so they must never contain input from
+// untrusted sources. The caller must close the returned rows. The operation
+// slot taken under WithMaxConcurrency is released once the query has started,
+// not when the rows are closed.
+func (p *PostgresStore) QueryActive(ctx context.Context, selectList, clauses string, args ...interface{}) (*sql.Rows, error) {
+	if err := p.checkDB(); err != nil {
+		return nil, err
+	}
+	defer p.observe("QueryActive")()
+	release, err := p.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s", selectList, p.opts.sessionTableName, p.activePredicate())
+	if clauses != "" {
+		query += " " + clauses
+	}
+	rows, err := p.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, classifyError(err)
+	}
+	return rows, nil
+}
+
+// ExpiryHistogram counts the active sessions by the time remaining until they
+// expire. The buckets are the upper bounds of each range, in ascending order,
+// and the returned slice has one more element than buckets: element i counts
+// the sessions expiring at least buckets[i-1] (or zero) and less than
+// buckets[i] from now, and the last element counts the sessions expiring
+// later than that, including sessions which never expire.
+func (p *PostgresStore) ExpiryHistogram(buckets []time.Duration) ([]int, error) {
+	if err := p.checkDB(); err != nil {
+		return nil, err
+	}
+	defer p.observe("ExpiryHistogram")()
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	cases := make([]string, len(buckets))
+	args := &queryArgs{dialect: p.opts.dialect}
+	for i, bucket := range buckets {
+		if i > 0 && bucket <= buckets[i-1] {
+			return nil, fmt.Errorf("postgresstore: bucket %v is not greater than the previous bucket", bucket)
+		}
+		cases[i] = fmt.Sprintf("WHEN %s < %s + %s::float8 * interval '1 second' THEN %d", p.opts.expiryColumnName, p.nowExpr(), args.add(bucket.Seconds()), i)
+	}
+
+	bucket := strconv.Itoa(len(buckets))
+	if len(cases) > 0 {
+		bucket = fmt.Sprintf("CASE %s ELSE %d END", strings.Join(cases, " "), len(buckets))
+	}
+	rows, err := p.q.QueryContext(context.Background(), fmt.Sprintf(
+		"SELECT %s AS bucket, COUNT(*) FROM %s WHERE %s GROUP BY bucket",
+		bucket, p.opts.sessionTableName, p.activePredicate(),
+	), args.values...)
+	if err != nil {
+		return nil, classifyError(err)
+	}
+	defer rows.Close()
+
+	counts := make([]int, len(buckets)+1)
+	for rows.Next() {
+		var i, n int
+		err = rows.Scan(&i, &n)
+		if err != nil {
+			return nil, classifyError(err)
+		}
+		counts[i] = n
+	}
+	return counts, classifyError(rows.Err())
+}
+
+// ReadTx runs fn in a read-only, repeatable read transaction. The store passed
+// to fn runs its queries inside the transaction, so that multiple reads (such
+// as TableStats and All) see a consistent snapshot of the sessions table. The
+// store passed to fn doesn't use the read cache or fallback store, and must
+// not be used after fn returns.
+func (p *PostgresStore) ReadTx(ctx context.Context, fn func(*PostgresStore) error) error {
+	if err := p.checkDB(); err != nil {
+		return err
+	}
+	release, err := p.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	tx, err := p.beginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return classifyError(err)
+	}
+	defer tx.Rollback()
+
+	err = fn(p.withQueryer(tx))
+	if err != nil {
+		return err
+	}
+	return classifyError(tx.Commit())
+}
+
+// withQueryer returns a view of the store which runs its queries against q. The
+// view has no cleanup goroutine, read cache or fallback store.
+func (p *PostgresStore) withQueryer(q queryer) *PostgresStore {
+	opts := *p.opts
+	opts.fallbackStore = nil
+	view := &PostgresStore{
+		db:   p.db,
+		opts: &opts,
+	}
+	view.q = view.wrapQueryer(q)
+	return view
+}
+
+// BindConn returns a view of the store which runs all of its queries on conn,
+// so that a sequence of operations can rely on session-level state, such as
+// settings or temporary tables, on a single connection. Like the store passed
+// to ReadTx's function, the view has no cleanup goroutine, read cache or
+// fallback store. It must not be used after conn is closed, and it must not be
+// used concurrently, because a connection can only run one query at a time.
+func (p *PostgresStore) BindConn(conn *sql.Conn) *PostgresStore {
+	view := p.withQueryer(conn)
+	view.conn = conn
+	return view
+}
+
+// beginTx starts a transaction on the store's connection if it is a view
+// returned by BindConn, or on the database pool otherwise.
+func (p *PostgresStore) beginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	if p.conn != nil {
+		return p.conn.BeginTx(ctx, opts)
+	}
+	return p.db.get().BeginTx(ctx, opts)
+}
+
+// writeTx calls fn with a view of the store which runs its queries in a
+// transaction at the isolation level set with WithIsolationLevel, retrying it
+// on serialization failures up to the configured number of times. Events
+// published by fn are only forwarded once its transaction has been committed.
+// If no isolation level was set, fn is called with the store itself.
+func (p *PostgresStore) writeTx(ctx context.Context, fn func(view *PostgresStore) error) error {
+	if p.opts.isolationLevel == sql.LevelDefault {
+		return fn(p)
+	}
+	for attempt := 0; ; attempt++ {
+		err := p.writeTxOnce(ctx, fn)
+		if !errors.Is(err, ErrSerializationFailure) || attempt >= p.opts.isolationRetries {
+			return err
+		}
+	}
+}
+
+func (p *PostgresStore) writeTxOnce(ctx context.Context, fn func(view *PostgresStore) error) error {
+	tx, err := p.beginTx(ctx, &sql.TxOptions{Isolation: p.opts.isolationLevel})
+	if err != nil {
+		return classifyError(err)
+	}
+	defer tx.Rollback()
+
+	view := p.withQueryer(tx)
+	var sink *collectingSink
+	if p.opts.eventSink != nil {
+		sink = &collectingSink{}
+		view.opts.eventSink = sink
+	}
+	if err = fn(view); err != nil {
+		return classifyError(err)
+	}
+	if err = tx.Commit(); err != nil {
+		return classifyError(err)
+	}
+
+	if sink != nil {
+		for _, event := range sink.events {
+			p.opts.eventSink.Publish(event)
+		}
+	}
+	return nil
+}
+
+// Warmup opens and pings up to conns connections in the database pool, so that
+// they're ready before the store starts receiving traffic. The connections are
+// held open together until all of them have been established, then returned to
+// the pool. Note that the pool only keeps as many idle connections as allowed
+// by sql.DB.SetMaxIdleConns, which defaults to 2. An error is returned if
+// conns is negative.
+func (p *PostgresStore) Warmup(ctx context.Context, conns int) error {
+	if err := p.checkDB(); err != nil {
+		return err
+	}
+	if conns < 0 {
+		return errors.New("postgresstore: connection count must not be negative")
+	}
+
+	held := make([]*sql.Conn, 0, conns)
+	defer func() {
+		for _, conn := range held {
+			conn.Close()
+		}
+	}()
+
+	for i := 0; i < conns; i++ {
+		conn, err := p.db.get().Conn(ctx)
+		if err != nil {
+			return classifyError(err)
+		}
+		held = append(held, conn)
+
+		err = conn.PingContext(ctx)
+		if err != nil {
+			return classifyError(err)
+		}
+	}
+
+	return nil
+}
+
+// acquire waits for one of the operation slots configured by
+// WithMaxConcurrency, and returns a function which releases it. If the store
+// was created with WithFailFast, ErrTooManyOperations is returned instead of
+// waiting when all of the slots are in use.
+func (p *PostgresStore) acquire(ctx context.Context) (release func(), err error) {
+	if p.sem == nil {
+		return func() {}, nil
+	}
+	if p.opts.failFast {
+		select {
+		case p.sem <- struct{}{}:
+		default:
+			return nil, ErrTooManyOperations
+		}
+	} else {
+		select {
+		case p.sem <- struct{}{}:
+		case <-ctx.Done():
+			return nil, classifyError(ctx.Err())
+		}
+	}
+	return func() { <-p.sem }, nil
+}
+
+// checkDB returns ErrNilDB if the store has no database handle, for example
+// because it is a nil pointer or wasn't created with New or NewStore.
+func (p *PostgresStore) checkDB() error {
+	if p == nil || p.db == nil || p.q == nil || p.opts == nil {
+		return ErrNilDB
+	}
+	return nil
+}
+
+// checkExpiry returns ErrExpiryInPast if the store was created with the
+// WithRejectPastExpiry option and expiry is set but not in the future.
+func (p *PostgresStore) checkExpiry(expiry time.Time) error {
+	if p.opts.rejectPastExpiry && !expiry.IsZero() && !expiry.After(time.Now()) {
+		return ErrExpiryInPast
+	}
+	return nil
+}
+
+// activePredicate returns the SQL condition which matches sessions that have
+// not expired and, if the store has a type, are of that type. Sessions with a
+// NULL expiry never expire.
+func (p *PostgresStore) activePredicate() string {
+	return p.activePredicateAt(p.nowExpr())
+}
+
+// activePredicateAt is the same as activePredicate, except that the current
+// time is given by the SQL expression now.
+func (p *PostgresStore) activePredicateAt(now string) string {
+	conditions := []string{p.unexpiredPredicateAt(now)}
+	if p.opts.deletedAtColumnName != "" {
+		conditions = append(conditions, p.opts.deletedAtColumnName+" IS NULL")
+	}
+	if p.opts.sessionType != "" {
+		conditions = append(conditions, p.typeCondition())
+	}
+	if len(conditions) == 1 {
+		return conditions[0]
+	}
+	return "(" + strings.Join(conditions, " AND ") + ")"
+}
+
+// unexpiredPredicateAt is the same as activePredicateAt, except that it
+// matches sessions of every type.
+func (p *PostgresStore) unexpiredPredicateAt(now string) string {
+	predicate := fmt.Sprintf("(%s IS NULL OR %s < %s)", p.opts.expiryColumnName, now, p.opts.expiryColumnName)
+	if p.opts.activePredicate != nil {
+		predicate = "(" + p.opts.activePredicate(now) + ")"
+	}
+	if p.opts.absoluteExpiryColumnName != "" {
+		predicate = fmt.Sprintf(
+			"(%s AND (%s IS NULL OR %s < %s))",
+			predicate, p.opts.absoluteExpiryColumnName, now, p.opts.absoluteExpiryColumnName,
+		)
+	}
+	return predicate
+}
+
+// expiredPredicate returns the SQL condition which matches sessions that the
+// cleanup should delete, where the current time is given by the SQL expression
+// now. Sessions with a NULL expiry, and those in the grace period set with
+// WithExpiryGraceWindow, are not matched. The condition set with
+// WithCleanupPartitionFilter, if any, is added to it, and only sessions of the
+// store's type are matched if it has one.
+func (p *PostgresStore) expiredPredicate(now string) string {
+	now = p.graceExpr(now)
+	var predicate string
+	switch {
+	case p.opts.activePredicate != nil:
+		predicate = "NOT " + p.unexpiredPredicateAt(now)
+	case p.opts.absoluteExpiryColumnName != "":
+		predicate = fmt.Sprintf(
+			"(%s < %s OR %s < %s)",
+			p.opts.expiryColumnName, now, p.opts.absoluteExpiryColumnName, now,
+		)
+	default:
+		// The IS NOT NULL condition is redundant, but it lets the planner use
+		// a partial index on the expiry column which excludes NULL expiries.
+		predicate = fmt.Sprintf(
+			"%s IS NOT NULL AND %s < %s",
+			p.opts.expiryColumnName, p.opts.expiryColumnName, now,
+		)
+	}
+	if p.opts.cleanupPartitionFilter != nil {
+		predicate = fmt.Sprintf("(%s) AND (%s)", predicate, p.opts.cleanupPartitionFilter(now))
+	}
+	return predicate + p.typeFilter()
+}
+
+// graceExpr returns the SQL expression for the time that expiry times are
+// compared against to find the sessions which have expired and are past the
+// grace period set with WithExpiryGraceWindow, given the SQL expression for the
+// current time. It is now if there is no grace period.
+func (p *PostgresStore) graceExpr(now string) string {
+	if p.opts.expiryGraceWindow == 0 {
+		return now
+	}
+	return fmt.Sprintf("(%s - interval '%d microseconds')", now, p.opts.expiryGraceWindow.Microseconds())
+}
+
+// typeCondition returns the SQL condition which matches the sessions of the
+// type set with WithType. The type is included as a literal, so that the
+// condition can be added to any query without renumbering its placeholders.
+func (p *PostgresStore) typeCondition() string {
+	return fmt.Sprintf("%s = %s", p.opts.typeColumnName, pq.QuoteLiteral(p.opts.sessionType))
+}
+
+// typeFilter returns typeCondition preceded by " AND ", to be appended to a
+// WHERE clause, or an empty string if the store has no type.
+func (p *PostgresStore) typeFilter() string {
+	if p.opts.sessionType == "" {
+		return ""
+	}
+	return " AND " + p.typeCondition()
+}
+
+// nowExpr returns the SQL expression for the current time that expiry times
+// are compared against. This is current_timestamp, unless the store was
+// created with the WithNowFunc option, in which case it is a literal holding
+// the time returned by the function.
+func (p *PostgresStore) nowExpr() string {
+	if p.opts.nowFunc == nil {
+		return "current_timestamp"
+	}
+	return fmt.Sprintf("'%s'::timestamptz", p.opts.nowFunc().UTC().Format(time.RFC3339Nano))
+}
+
+// updatedAtExpr returns the SQL expression that the updated-at column is set
+// to. On PostgreSQL this is clock_timestamp(), the time at which the statement
+// runs, rather than current_timestamp, which is the time at which its
+// transaction started.
+func (p *PostgresStore) updatedAtExpr() string {
+	if _, ok := p.opts.dialect.(PostgresDialect); ok {
+		return "clock_timestamp()"
+	}
+	return "current_timestamp"
+}
+
+// capExpiry returns the SQL expression to set the expiry column to when
+// updating it to expr, which caps it at the absolute expiry if one is
+// configured.
+func (p *PostgresStore) capExpiry(expr string) string {
+	if p.opts.absoluteExpiryColumnName == "" {
+		return expr
+	}
+	return fmt.Sprintf("LEAST(%s, %s.%s)", expr, p.opts.sessionTableName, p.opts.absoluteExpiryColumnName)
+}
+
+// dataExpr returns the SQL expression for reading the session data.
+func (p *PostgresStore) dataExpr() string {
+	if p.opts.largeObjectData {
+		return fmt.Sprintf("lo_get(%s)", p.opts.dataColumnName)
+	}
+	return p.opts.dataColumnName
+}
+
+// storedToken returns the value stored in the token column for token. This is
+// token itself, unless the store was created with the WithTokenHMAC option.
+func (p *PostgresStore) storedToken(token string) string {
+	if p.opts.tokenHMACKey == nil {
+		return token
+	}
+	mac := hmac.New(sha256.New, p.opts.tokenHMACKey)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// tokenArg returns the value to bind for a single token in a query: the stored
+// token, converted by the function passed to WithTokenBinder if there is one.
+func (p *PostgresStore) tokenArg(token string) interface{} {
+	stored := p.storedToken(token)
+	if p.opts.tokenBinder == nil {
+		return stored
+	}
+	return p.opts.tokenBinder(stored)
+}
+
+// storedTokens is the same as storedToken, for each of the given tokens.
+func (p *PostgresStore) storedTokens(tokens []string) []string {
+	if p.opts.tokenHMACKey == nil {
+		return tokens
+	}
+	stored := make([]string, len(tokens))
+	for i, token := range tokens {
+		stored[i] = p.storedToken(token)
+	}
+	return stored
+}
+
+// nullString returns the value to bind for an optional string, mapping the
+// empty string to NULL.
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// dataValue returns the value to bind for session data. When the data column
+// is a jsonb column the data is bound as text, as binding it as bytea would be
+// rejected by PostgreSQL.
+func (p *PostgresStore) dataValue(b []byte) interface{} {
+	if p.opts.jsonb {
+		return string(b)
+	}
+	return b
+}
+
+// expiryValue returns the value to bind for an expiry time, mapping the zero
+// time to NULL. The time is converted to UTC, because the driver sends it with
+// the offset of its location, which a timestamp without time zone column would
+// silently drop.
+func expiryValue(expiry time.Time) interface{} {
+	if expiry.IsZero() {
+		return nil
+	}
+	return expiry.UTC()
+}
+
+// useFallback reports whether an operation which returned err should be
+// retried against the fallback store. It also keeps track of whether the store
+// is currently degraded, logging when it enters and leaves that state.
+func (p *PostgresStore) useFallback(err error) bool {
+	if p.opts.fallbackStore == nil {
+		return false
+	}
+
+	isConnErr := isConnectionError(err)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if isConnErr && !p.degraded {
+		log.Printf("postgresstore: database unavailable, using fallback store: %v", err)
+	} else if !isConnErr && p.degraded {
+		log.Println("postgresstore: database available again, resuming normal operation")
+	}
+	p.degraded = isConnErr
+
+	return isConnErr
 }
@@ -0,0 +1,9 @@
+module github.com/alexedwards/scs/postgresstore/postgresstoreprom
+
+go 1.14
+
+require (
+	github.com/alexedwards/scs/postgresstore v0.2.0
+	github.com/lib/pq v1.4.0
+	github.com/prometheus/client_golang v1.11.1
+)
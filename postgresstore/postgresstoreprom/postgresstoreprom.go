@@ -0,0 +1,68 @@
+// Package postgresstoreprom provides a Prometheus collector for the metrics of
+// a postgresstore.PostgresStore. It is a separate module, so that the
+// postgresstore package doesn't depend on the Prometheus client.
+package postgresstoreprom
+
+import (
+	"time"
+
+	"github.com/alexedwards/scs/postgresstore"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector is a prometheus.Collector for the operations and cleanup of a
+// PostgresStore. Create one with NewCollector, register it with your registry
+// and pass the result of its Options method to postgresstore.New.
+type Collector struct {
+	operations *prometheus.HistogramVec
+	cleaned    prometheus.Counter
+}
+
+// NewCollector returns a new Collector. The metrics are named with the
+// postgresstore_ prefix, and constLabels are added to all of them, which lets
+// the metrics of several stores be registered with the same registry.
+func NewCollector(constLabels prometheus.Labels) *Collector {
+	return &Collector{
+		operations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        "postgresstore_operation_duration_seconds",
+			Help:        "Duration of session store operations, by operation.",
+			ConstLabels: constLabels,
+			Buckets:     prometheus.DefBuckets,
+		}, []string{"op"}),
+		cleaned: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "postgresstore_cleanup_deleted_sessions_total",
+			Help:        "Number of expired sessions removed by the background cleanup.",
+			ConstLabels: constLabels,
+		}),
+	}
+}
+
+// Options returns the store options which feed the collector. They use the
+// WithSlowQueryThreshold and WithCleanupExpiryHook options, which add to any
+// handlers set with those options rather than replacing them.
+func (c *Collector) Options() []postgresstore.StoreOption {
+	return []postgresstore.StoreOption{
+		postgresstore.WithSlowQueryThreshold(0, c.observe),
+		postgresstore.WithCleanupExpiryHook(c.observeCleanup),
+	}
+}
+
+func (c *Collector) observe(op string, d time.Duration) {
+	c.operations.WithLabelValues(op).Observe(d.Seconds())
+}
+
+func (c *Collector) observeCleanup(expiries []time.Time) {
+	c.cleaned.Add(float64(len(expiries)))
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.operations.Describe(ch)
+	c.cleaned.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.operations.Collect(ch)
+	c.cleaned.Collect(ch)
+}
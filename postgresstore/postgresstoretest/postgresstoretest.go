@@ -0,0 +1,65 @@
+// Package postgresstoretest provides helpers for writing tests against
+// postgresstore.PostgresStore. It is kept separate from the postgresstore
+// package so that the testing package isn't imported by production builds.
+package postgresstoretest
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/alexedwards/scs/postgresstore"
+)
+
+// NewTestStore returns a PostgresStore for use in tests, backed by a new
+// sessions table with a unique name, so that tests which run at the same time
+// against the same database don't share sessions. The table and its index are
+// created in db, and dropped when the test finishes, so db must not be closed
+// until then: close it with t.Cleanup, registered before NewTestStore is
+// called, rather than with defer. The expiry column is nullable so that
+// sessions which never expire can be stored, and the expiry index is a partial
+// index which leaves them out. The background cleanup goroutine is disabled
+// unless re-enabled in opts, in which case it is stopped when the test
+// finishes. The table name is chosen by NewTestStore, so opts should not
+// include WithSessionTableName.
+func NewTestStore(t testing.TB, db *sql.DB, opts ...postgresstore.StoreOption) *postgresstore.PostgresStore {
+	t.Helper()
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		t.Fatal(err)
+	}
+	table := "postgresstoretest_" + hex.EncodeToString(suffix)
+
+	t.Cleanup(func() {
+		_, err := db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", table))
+		if err != nil {
+			t.Errorf("postgresstoretest: dropping table %s: %v", table, err)
+		}
+	})
+	queries := []string{
+		fmt.Sprintf(`CREATE TABLE %s (
+			token TEXT PRIMARY KEY,
+			data BYTEA NOT NULL,
+			expiry TIMESTAMPTZ
+		)`, table),
+		fmt.Sprintf("CREATE INDEX %s_expiry_idx ON %s (expiry) WHERE expiry IS NOT NULL", table, table),
+	}
+	for _, query := range queries {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts = append([]postgresstore.StoreOption{postgresstore.WithoutCleanup()}, opts...)
+	opts = append(opts, postgresstore.WithSessionTableName(table))
+	p, err := postgresstore.NewStore(db, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.StopCleanup)
+
+	return p
+}
@@ -0,0 +1,71 @@
+package postgresstoretest
+
+import (
+	"bytes"
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+func TestNewTestStore(t *testing.T) {
+	dsn := os.Getenv("SCS_POSTGRES_TEST_DSN")
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err = db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	countTables := func() int {
+		var n int
+		err := db.QueryRow("SELECT COUNT(*) FROM information_schema.tables WHERE table_name LIKE 'postgresstoretest\\_%'").Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	before := countTables()
+
+	t.Run("stores", func(t *testing.T) {
+		p := NewTestStore(t, db)
+
+		err = p.Commit("session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, found, err := p.Find("session_token")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != true {
+			t.Fatalf("got %v: expected %v", found, true)
+		}
+		if bytes.Equal(b, []byte("encoded_data")) == false {
+			t.Fatalf("got %v: expected %v", b, []byte("encoded_data"))
+		}
+
+		// Each store has its own table.
+		p = NewTestStore(t, db)
+
+		_, found, err = p.Find("session_token")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != false {
+			t.Fatalf("got %v: expected %v", found, false)
+		}
+		if n := countTables(); n != before+2 {
+			t.Fatalf("got %d tables: expected %d", n, before+2)
+		}
+	})
+
+	// The tables are dropped when the test finishes.
+	if n := countTables(); n != before {
+		t.Fatalf("got %d tables: expected %d", n, before)
+	}
+}
@@ -0,0 +1,295 @@
+package postgresstore
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The builders in this file generate the SQL for the core store operations
+// from the store's options, so that it can be tested without a database.
+
+// queryArgs collects the arguments of a query as it is built, numbering their
+// placeholders in the order they are added, so that optional clauses don't
+// need to renumber the placeholders which follow them.
+type queryArgs struct {
+	dialect Dialect
+	values  []interface{}
+}
+
+// add appends v to the arguments and returns the placeholder which refers to
+// it.
+func (a *queryArgs) add(v interface{}) string {
+	a.values = append(a.values, v)
+	return a.dialect.Placeholder(len(a.values))
+}
+
+// findQuery returns the query used by Find, which takes the stored token as
+// its only argument. Sessions in the grace period set with
+// WithExpiryGraceWindow are found.
+func (p *PostgresStore) findQuery() string {
+	return fmt.Sprintf(
+		"SELECT %s, %s FROM %s WHERE %s = %s AND %s",
+		p.dataExpr(), p.opts.expiryColumnName, p.opts.sessionTableName, p.opts.tokenColumnName, p.opts.dialect.Placeholder(1),
+		p.activePredicateAt(p.graceExpr(p.nowExpr())),
+	)
+}
+
+// commitQuery returns the upsert used by Commit and its arguments. It isn't
+// used by stores created with the WithLargeObjectData option.
+func (p *PostgresStore) commitQuery(token string, b []byte, expiry time.Time) (string, []interface{}) {
+	return p.commitManyQuery([]pendingWrite{{token: token, data: b, expiry: expiry}})
+}
+
+// commitManyQuery is the same as commitQuery, except that it writes each of
+// the sessions in writes, which must not be empty or repeat a token, in a
+// single statement with a row of values per session. The updated-at mode of
+// the first write applies to all of them.
+func (p *PostgresStore) commitManyQuery(writes []pendingWrite) (string, []interface{}) {
+	args := &queryArgs{dialect: p.opts.dialect}
+	var columns, updates []string
+	rows := make([]string, len(writes))
+	for i, w := range writes {
+		var values []string
+		columns, values = p.addCommitColumns(args, w.token, w.data, w.expiry)
+		updates = columns[1:]
+		columns, values = p.createColumns(columns, values, args)
+		rows[i] = "(" + strings.Join(values, ", ") + ")"
+	}
+	updates = append([]string(nil), updates...)
+	mode := writes[0].updatedAt
+	onChange := p.opts.updatedAtOnChange && mode == UpdatedAtDefault
+	if p.opts.updatedAtColumnName != "" && mode == UpdatedAtSuppress {
+		// The updated-at column follows the data and expiry, and is only
+		// written when the session is created.
+		updates = append(updates[:2], updates[3:]...)
+	}
+	upsert := p.opts.dialect.UpsertClause(p.opts.tokenColumnName, updates)
+	if p.opts.absoluteExpiryColumnName != "" || p.opts.versionColumnName != "" || p.opts.mergeOnConflict || onChange {
+		// The expiry is capped so that it is never later than the absolute
+		// expiry, the version is incremented, the data is merged and the
+		// updated-at column is only set if the data changes. This uses
+		// PostgreSQL syntax regardless of the dialect.
+		sets := make([]string, len(updates))
+		for i, column := range updates {
+			sets[i] = fmt.Sprintf("%s = EXCLUDED.%s", column, column)
+		}
+		stored := p.opts.sessionTableName + "." + p.opts.dataColumnName
+		data := "EXCLUDED." + p.opts.dataColumnName
+		if p.opts.mergeOnConflict {
+			data = stored + " || " + data
+			sets[0] = fmt.Sprintf("%s = %s", p.opts.dataColumnName, data)
+		}
+		sets[1] = fmt.Sprintf("%s = %s", p.opts.expiryColumnName, p.capExpiry("EXCLUDED."+p.opts.expiryColumnName))
+		if onChange {
+			// The updated-at column always follows the data and expiry. It
+			// is moved to the front, so that the comparison sees the stored
+			// data even on databases which apply the assignments in order.
+			bump := fmt.Sprintf(
+				"%s = CASE WHEN %s IS DISTINCT FROM %s THEN EXCLUDED.%s ELSE %s.%s END",
+				p.opts.updatedAtColumnName, stored, data, p.opts.updatedAtColumnName, p.opts.sessionTableName, p.opts.updatedAtColumnName,
+			)
+			sets = append([]string{bump, sets[0], sets[1]}, sets[3:]...)
+		}
+		if p.opts.versionColumnName != "" {
+			sets = append(sets, fmt.Sprintf("%s = %s.%s + 1", p.opts.versionColumnName, p.opts.sessionTableName, p.opts.versionColumnName))
+		}
+		upsert = fmt.Sprintf("ON CONFLICT (%s) DO UPDATE SET %s", p.opts.tokenColumnName, strings.Join(sets, ", "))
+	}
+
+	query := fmt.Sprintf(
+		"INSERT INTO %s (%s) VALUES %s %s",
+		p.opts.sessionTableName, strings.Join(columns, ", "), strings.Join(rows, ", "), upsert,
+	)
+	var conditions []string
+	if p.opts.conditionalUpdate {
+		// A NULL expiry never expires, so it is newer than any other expiry.
+		conditions = append(conditions, fmt.Sprintf(
+			"EXCLUDED.%s IS NULL OR (%s.%s IS NOT NULL AND EXCLUDED.%s > %s.%s)",
+			p.opts.expiryColumnName, p.opts.sessionTableName, p.opts.expiryColumnName,
+			p.opts.expiryColumnName, p.opts.sessionTableName, p.opts.expiryColumnName,
+		))
+	}
+	if p.opts.sessionType != "" {
+		// A session of another type with the same token is left alone.
+		conditions = append(conditions, fmt.Sprintf(
+			"%s.%s = EXCLUDED.%s",
+			p.opts.sessionTableName, p.opts.typeColumnName, p.opts.typeColumnName,
+		))
+	}
+	if len(conditions) == 1 {
+		query += " WHERE " + conditions[0]
+	} else if len(conditions) > 1 {
+		query += " WHERE (" + strings.Join(conditions, ") AND (") + ")"
+	}
+	return query, args.values
+}
+
+// touchUnchangedQuery returns the update used by Commit for stores created
+// with the WithExpiryOnlyUpdates option, and its arguments. It updates the
+// expiry of the session only if its stored data is the same as b, leaving the
+// updated-at column unchanged, and honours
+// WithConditionalUpdate and WithAbsoluteExpiry in the same way as commitQuery.
+func (p *PostgresStore) touchUnchangedQuery(token string, b []byte, expiry time.Time) (string, []interface{}) {
+	args := &queryArgs{dialect: p.opts.dialect}
+	tokenPlaceholder := args.add(p.tokenArg(token))
+	expiryPlaceholder := args.add(expiryValue(expiry))
+
+	// The updated-at column isn't set, as the data hasn't changed.
+	query := fmt.Sprintf(
+		"UPDATE %s SET %s = %s WHERE %s = %s AND %s = %s%s",
+		p.opts.sessionTableName, p.opts.expiryColumnName, p.capExpiry(expiryPlaceholder), p.opts.tokenColumnName, tokenPlaceholder,
+		p.opts.dataColumnName, args.add(p.dataValue(b)), p.typeFilter(),
+	)
+	if p.opts.conditionalUpdate {
+		query += fmt.Sprintf(
+			" AND (%s::timestamptz IS NULL OR (%s IS NOT NULL AND %s::timestamptz > %s))",
+			expiryPlaceholder, p.opts.expiryColumnName, expiryPlaceholder, p.opts.expiryColumnName,
+		)
+	}
+	if p.opts.deletedAtColumnName != "" {
+		// A deleted session is left to the upsert, which undeletes it.
+		query += fmt.Sprintf(" AND %s IS NULL", p.opts.deletedAtColumnName)
+	}
+	return query, args.values
+}
+
+// commitColumns returns the columns written by a commit, the SQL values for
+// them and the query arguments. The first three columns are always the token,
+// data and expiry columns, in that order.
+func (p *PostgresStore) commitColumns(token string, b []byte, expiry time.Time) (columns, values []string, args *queryArgs) {
+	args = &queryArgs{dialect: p.opts.dialect}
+	columns, values = p.addCommitColumns(args, token, b, expiry)
+	return columns, values, args
+}
+
+// addCommitColumns is the same as commitColumns, except that the arguments are
+// added to args.
+func (p *PostgresStore) addCommitColumns(args *queryArgs, token string, b []byte, expiry time.Time) (columns, values []string) {
+	columns = []string{p.opts.tokenColumnName, p.opts.dataColumnName, p.opts.expiryColumnName}
+	values = []string{args.add(p.tokenArg(token)), args.add(p.dataValue(b)), args.add(expiryValue(expiry))}
+	if p.opts.updatedAtColumnName != "" {
+		columns = append(columns, p.opts.updatedAtColumnName)
+		values = append(values, p.updatedAtExpr())
+	}
+	if p.opts.subjectFunc != nil {
+		columns = append(columns, p.opts.subjectColumnName)
+		values = append(values, args.add(nullString(p.opts.subjectFunc(token, b))))
+	}
+	if p.opts.sessionType != "" {
+		columns = append(columns, p.opts.typeColumnName)
+		values = append(values, args.add(p.opts.sessionType))
+	}
+	if p.opts.deletedAtColumnName != "" {
+		// Committing a deleted session undeletes it.
+		columns = append(columns, p.opts.deletedAtColumnName)
+		values = append(values, "NULL")
+	}
+	return columns, values
+}
+
+// createColumns adds the columns which are only written when a session is
+// created to the result of commitColumns. The creation time and absolute
+// expiry are set when a session is created and never updated, and the expiry
+// is capped so that it is never later than the absolute expiry. The version of
+// a new session is 1.
+func (p *PostgresStore) createColumns(columns, values []string, args *queryArgs) ([]string, []string) {
+	if p.opts.createdAtColumnName != "" {
+		columns = append(columns, p.opts.createdAtColumnName)
+		values = append(values, "current_timestamp")
+	}
+	if p.opts.absoluteExpiryColumnName != "" {
+		placeholder := args.add(time.Now().Add(p.opts.absoluteLifetime).UTC())
+		columns = append(columns, p.opts.absoluteExpiryColumnName)
+		values = append(values, placeholder)
+		values[2] = fmt.Sprintf("LEAST(%s::timestamptz, %s::timestamptz)", values[2], placeholder)
+	}
+	if p.opts.versionColumnName != "" {
+		columns = append(columns, p.opts.versionColumnName)
+		values = append(values, "1")
+	}
+	return columns, values
+}
+
+// deleteQuery returns the query used by Delete, which takes the stored token
+// as its only argument.
+func (p *PostgresStore) deleteQuery() string {
+	if p.opts.deletedAtColumnName != "" {
+		// The row, and any large object holding its data, are kept until
+		// the cleanup removes them. The deletion time comes from the
+		// database, like the creation time, even with WithNowFunc.
+		return fmt.Sprintf(
+			"UPDATE %s SET %s = current_timestamp WHERE %s = %s AND %s IS NULL%s",
+			p.opts.sessionTableName, p.opts.deletedAtColumnName, p.opts.tokenColumnName, p.opts.dialect.Placeholder(1),
+			p.opts.deletedAtColumnName, p.typeFilter(),
+		)
+	}
+	if p.opts.largeObjectData {
+		return fmt.Sprintf(
+			"WITH d AS (DELETE FROM %s WHERE %s = %s%s RETURNING %s) SELECT lo_unlink(%s) FROM d",
+			p.opts.sessionTableName, p.opts.tokenColumnName, p.opts.dialect.Placeholder(1), p.typeFilter(), p.opts.dataColumnName, p.opts.dataColumnName,
+		)
+	}
+	return fmt.Sprintf(
+		"DELETE FROM %s WHERE %s = %s%s",
+		p.opts.sessionTableName, p.opts.tokenColumnName, p.opts.dialect.Placeholder(1), p.typeFilter(),
+	)
+}
+
+// deleteExpiredQuery returns the query used by the cleanup to delete up to
+// limit expired sessions, or all of them if limit is zero, and its arguments.
+// If returning is true, the query returns the token and expiry time of each
+// deleted session. It must be true for stores created with the
+// WithLargeObjectData option. If the store was created with the WithNowFunc
+// option, the current time is bound as an argument.
+func (p *PostgresStore) deleteExpiredQuery(limit int, returning bool) (string, []interface{}) {
+	now := "current_timestamp"
+	args := &queryArgs{dialect: p.opts.dialect}
+	if p.opts.nowFunc != nil {
+		now = args.add(p.opts.nowFunc())
+	}
+
+	query := fmt.Sprintf(
+		"DELETE FROM %s WHERE %s",
+		p.opts.sessionTableName, p.expiredPredicate(now),
+	)
+	if limit > 0 || p.opts.cleanupStrategy == CleanupSkipLocked {
+		subquery := fmt.Sprintf(
+			"SELECT %s FROM %s WHERE %s",
+			p.opts.tokenColumnName, p.opts.sessionTableName, p.expiredPredicate(now),
+		)
+		if limit > 0 {
+			subquery += fmt.Sprintf(" LIMIT %d", limit)
+		}
+		if p.opts.cleanupStrategy == CleanupSkipLocked {
+			subquery += " FOR UPDATE SKIP LOCKED"
+		}
+		query = fmt.Sprintf(
+			"DELETE FROM %s WHERE %s IN (%s)",
+			p.opts.sessionTableName, p.opts.tokenColumnName, subquery,
+		)
+	}
+	if !returning {
+		return query, args.values
+	}
+
+	query = fmt.Sprintf("%s RETURNING %s, %s", query, p.opts.tokenColumnName, p.opts.expiryColumnName)
+	if p.opts.largeObjectData {
+		// The large objects holding the data of the deleted sessions are
+		// unlinked in the same statement, so that they aren't orphaned.
+		query = fmt.Sprintf(
+			"WITH d AS (%s, %s) SELECT %s, %s FROM d WHERE %s",
+			query, p.opts.dataColumnName, p.opts.tokenColumnName, p.opts.expiryColumnName, p.unlinkCondition(),
+		)
+	}
+	return query, args.values
+}
+
+// unlinkCondition returns the SQL condition which unlinks the large object
+// holding the data of each row returned by a DELETE, for stores created with
+// the WithLargeObjectData option. It matches every row, including rows whose
+// data is NULL, which have no large object to unlink, so that they are still
+// returned and counted.
+func (p *PostgresStore) unlinkCondition() string {
+	return fmt.Sprintf("(%s IS NULL OR lo_unlink(%s) = 1)", p.opts.dataColumnName, p.opts.dataColumnName)
+}
@@ -0,0 +1,421 @@
+package postgresstore
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newQueryTestStore(t testing.TB, opts ...StoreOption) *PostgresStore {
+	db, err := sql.Open("postgres", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	p, err := NewStore(db, append([]StoreOption{WithoutCleanup()}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestFindQuery(t *testing.T) {
+	tests := []struct {
+		opts     []StoreOption
+		expected string
+	}{
+		{
+			nil,
+			"SELECT data, expiry FROM sessions WHERE token = $1 AND (expiry IS NULL OR current_timestamp < expiry)",
+		},
+		{
+			[]StoreOption{WithSessionTableName("web_sessions"), WithDialect(SQLiteDialect{})},
+			"SELECT data, expiry FROM web_sessions WHERE token = ? AND (expiry IS NULL OR current_timestamp < expiry)",
+		},
+		{
+			[]StoreOption{WithLargeObjectData()},
+			"SELECT lo_get(data), expiry FROM sessions WHERE token = $1 AND (expiry IS NULL OR current_timestamp < expiry)",
+		},
+		{
+			[]StoreOption{WithType("web")},
+			"SELECT data, expiry FROM sessions WHERE token = $1 AND ((expiry IS NULL OR current_timestamp < expiry) AND type = 'web')",
+		},
+		{
+			[]StoreOption{WithDeletedAtColumnName("deleted_at"), WithType("web")},
+			"SELECT data, expiry FROM sessions WHERE token = $1 AND ((expiry IS NULL OR current_timestamp < expiry) AND deleted_at IS NULL AND type = 'web')",
+		},
+		{
+			[]StoreOption{WithExpiryGraceWindow(90 * time.Second)},
+			"SELECT data, expiry FROM sessions WHERE token = $1 AND (expiry IS NULL OR (current_timestamp - interval '90000000 microseconds') < expiry)",
+		},
+	}
+	for _, test := range tests {
+		query := newQueryTestStore(t, test.opts...).findQuery()
+		if query != test.expected {
+			t.Fatalf("got %q: expected %q", query, test.expected)
+		}
+	}
+}
+
+func TestCommitQuery(t *testing.T) {
+	tests := []struct {
+		opts     []StoreOption
+		expected string
+		args     int
+	}{
+		{
+			nil,
+			"INSERT INTO sessions (token, data, expiry) VALUES ($1, $2, $3) ON CONFLICT (token) DO UPDATE SET data = EXCLUDED.data, expiry = EXCLUDED.expiry",
+			3,
+		},
+		{
+			[]StoreOption{WithUpdatedAtColumnName("updated_at"), WithCreatedAtColumnName("created_at")},
+			"INSERT INTO sessions (token, data, expiry, updated_at, created_at) VALUES ($1, $2, $3, clock_timestamp(), current_timestamp) ON CONFLICT (token) DO UPDATE SET data = EXCLUDED.data, expiry = EXCLUDED.expiry, updated_at = EXCLUDED.updated_at",
+			3,
+		},
+		{
+			[]StoreOption{WithConditionalUpdate()},
+			"INSERT INTO sessions (token, data, expiry) VALUES ($1, $2, $3) ON CONFLICT (token) DO UPDATE SET data = EXCLUDED.data, expiry = EXCLUDED.expiry WHERE EXCLUDED.expiry IS NULL OR (sessions.expiry IS NOT NULL AND EXCLUDED.expiry > sessions.expiry)",
+			3,
+		},
+		{
+			[]StoreOption{WithVersionColumnName("version")},
+			"INSERT INTO sessions (token, data, expiry, version) VALUES ($1, $2, $3, 1) ON CONFLICT (token) DO UPDATE SET data = EXCLUDED.data, expiry = EXCLUDED.expiry, version = sessions.version + 1",
+			3,
+		},
+		{
+			[]StoreOption{WithSubjectColumn("subject", func(token string, data []byte) string { return "" }), WithAbsoluteExpiry("absolute_expiry", time.Hour)},
+			"INSERT INTO sessions (token, data, expiry, subject, absolute_expiry) VALUES ($1, $2, LEAST($3::timestamptz, $5::timestamptz), $4, $5) ON CONFLICT (token) DO UPDATE SET data = EXCLUDED.data, expiry = LEAST(EXCLUDED.expiry, sessions.absolute_expiry), subject = EXCLUDED.subject",
+			5,
+		},
+		{
+			[]StoreOption{WithUpdatedAtColumnName("updated_at"), WithUpdatedAtOnChange()},
+			"INSERT INTO sessions (token, data, expiry, updated_at) VALUES ($1, $2, $3, clock_timestamp()) ON CONFLICT (token) DO UPDATE SET updated_at = CASE WHEN sessions.data IS DISTINCT FROM EXCLUDED.data THEN EXCLUDED.updated_at ELSE sessions.updated_at END, data = EXCLUDED.data, expiry = EXCLUDED.expiry",
+			3,
+		},
+		{
+			[]StoreOption{WithJSONB(), WithMergeOnConflict()},
+			"INSERT INTO sessions (token, data, expiry) VALUES ($1, $2, $3) ON CONFLICT (token) DO UPDATE SET data = sessions.data || EXCLUDED.data, expiry = EXCLUDED.expiry",
+			3,
+		},
+		{
+			[]StoreOption{WithType("web"), WithConditionalUpdate()},
+			"INSERT INTO sessions (token, data, expiry, type) VALUES ($1, $2, $3, $4) ON CONFLICT (token) DO UPDATE SET data = EXCLUDED.data, expiry = EXCLUDED.expiry, type = EXCLUDED.type WHERE (EXCLUDED.expiry IS NULL OR (sessions.expiry IS NOT NULL AND EXCLUDED.expiry > sessions.expiry)) AND (sessions.type = EXCLUDED.type)",
+			4,
+		},
+		{
+			[]StoreOption{WithDeletedAtColumnName("deleted_at")},
+			"INSERT INTO sessions (token, data, expiry, deleted_at) VALUES ($1, $2, $3, NULL) ON CONFLICT (token) DO UPDATE SET data = EXCLUDED.data, expiry = EXCLUDED.expiry, deleted_at = EXCLUDED.deleted_at",
+			3,
+		},
+		{
+			[]StoreOption{WithDialect(SQLiteDialect{}), WithUpdatedAtColumnName("updated_at")},
+			"INSERT INTO sessions (token, data, expiry, updated_at) VALUES (?, ?, ?, current_timestamp) ON CONFLICT (token) DO UPDATE SET data = EXCLUDED.data, expiry = EXCLUDED.expiry, updated_at = EXCLUDED.updated_at",
+			3,
+		},
+		{
+			[]StoreOption{WithDialect(MySQLDialect{}), WithSubjectColumn("subject", func(token string, data []byte) string { return "" })},
+			"INSERT INTO sessions (token, data, expiry, subject) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE data = VALUES(data), expiry = VALUES(expiry), subject = VALUES(subject)",
+			4,
+		},
+	}
+	for _, test := range tests {
+		query, args := newQueryTestStore(t, test.opts...).commitQuery("session_token", []byte("encoded_data"), time.Now())
+		if query != test.expected {
+			t.Fatalf("got %q: expected %q", query, test.expected)
+		}
+		if len(args) != test.args {
+			t.Fatalf("got %d args: expected %d", len(args), test.args)
+		}
+	}
+}
+
+func TestCommitManyQuery(t *testing.T) {
+	writes := []pendingWrite{
+		{token: "session_token_1", data: []byte("encoded_data_1"), expiry: time.Now()},
+		{token: "session_token_2", data: []byte("encoded_data_2"), expiry: time.Now()},
+	}
+	tests := []struct {
+		opts     []StoreOption
+		expected string
+		args     int
+	}{
+		{
+			nil,
+			"INSERT INTO sessions (token, data, expiry) VALUES ($1, $2, $3), ($4, $5, $6) ON CONFLICT (token) DO UPDATE SET data = EXCLUDED.data, expiry = EXCLUDED.expiry",
+			6,
+		},
+		{
+			[]StoreOption{WithUpdatedAtColumnName("updated_at"), WithAbsoluteExpiry("absolute_expiry", time.Hour)},
+			"INSERT INTO sessions (token, data, expiry, updated_at, absolute_expiry) VALUES ($1, $2, LEAST($3::timestamptz, $4::timestamptz), clock_timestamp(), $4), ($5, $6, LEAST($7::timestamptz, $8::timestamptz), clock_timestamp(), $8) ON CONFLICT (token) DO UPDATE SET data = EXCLUDED.data, expiry = LEAST(EXCLUDED.expiry, sessions.absolute_expiry), updated_at = EXCLUDED.updated_at",
+			8,
+		},
+	}
+	for _, test := range tests {
+		query, args := newQueryTestStore(t, test.opts...).commitManyQuery(writes)
+		if query != test.expected {
+			t.Fatalf("got %q: expected %q", query, test.expected)
+		}
+		if len(args) != test.args {
+			t.Fatalf("got %d args: expected %d", len(args), test.args)
+		}
+	}
+}
+
+func TestCommitQueryUpdatedAtMode(t *testing.T) {
+	tests := []struct {
+		opts     []StoreOption
+		mode     UpdatedAtMode
+		expected string
+	}{
+		{
+			[]StoreOption{WithUpdatedAtColumnName("updated_at")},
+			UpdatedAtSuppress,
+			"INSERT INTO sessions (token, data, expiry, updated_at) VALUES ($1, $2, $3, clock_timestamp()) ON CONFLICT (token) DO UPDATE SET data = EXCLUDED.data, expiry = EXCLUDED.expiry",
+		},
+		{
+			[]StoreOption{WithUpdatedAtColumnName("updated_at"), WithSubjectColumn("subject", func(token string, data []byte) string { return "" })},
+			UpdatedAtSuppress,
+			"INSERT INTO sessions (token, data, expiry, updated_at, subject) VALUES ($1, $2, $3, clock_timestamp(), $4) ON CONFLICT (token) DO UPDATE SET data = EXCLUDED.data, expiry = EXCLUDED.expiry, subject = EXCLUDED.subject",
+		},
+		{
+			[]StoreOption{WithUpdatedAtColumnName("updated_at"), WithUpdatedAtOnChange()},
+			UpdatedAtSuppress,
+			"INSERT INTO sessions (token, data, expiry, updated_at) VALUES ($1, $2, $3, clock_timestamp()) ON CONFLICT (token) DO UPDATE SET data = EXCLUDED.data, expiry = EXCLUDED.expiry",
+		},
+		{
+			[]StoreOption{WithUpdatedAtColumnName("updated_at"), WithUpdatedAtOnChange()},
+			UpdatedAtForce,
+			"INSERT INTO sessions (token, data, expiry, updated_at) VALUES ($1, $2, $3, clock_timestamp()) ON CONFLICT (token) DO UPDATE SET data = EXCLUDED.data, expiry = EXCLUDED.expiry, updated_at = EXCLUDED.updated_at",
+		},
+		{
+			nil,
+			UpdatedAtSuppress,
+			"INSERT INTO sessions (token, data, expiry) VALUES ($1, $2, $3) ON CONFLICT (token) DO UPDATE SET data = EXCLUDED.data, expiry = EXCLUDED.expiry",
+		},
+	}
+	for _, test := range tests {
+		writes := []pendingWrite{{token: "session_token", data: []byte("encoded_data"), expiry: time.Now(), updatedAt: test.mode}}
+		query, _ := newQueryTestStore(t, test.opts...).commitManyQuery(writes)
+		if query != test.expected {
+			t.Fatalf("got %q: expected %q", query, test.expected)
+		}
+	}
+}
+
+func TestTouchUnchangedQuery(t *testing.T) {
+	tests := []struct {
+		opts     []StoreOption
+		expected string
+	}{
+		{
+			nil,
+			"UPDATE sessions SET expiry = $2 WHERE token = $1 AND data = $3",
+		},
+		{
+			[]StoreOption{WithUpdatedAtColumnName("updated_at"), WithAbsoluteExpiry("absolute_expiry", time.Hour)},
+			"UPDATE sessions SET expiry = LEAST($2, sessions.absolute_expiry) WHERE token = $1 AND data = $3",
+		},
+		{
+			[]StoreOption{WithConditionalUpdate()},
+			"UPDATE sessions SET expiry = $2 WHERE token = $1 AND data = $3 AND ($2::timestamptz IS NULL OR (expiry IS NOT NULL AND $2::timestamptz > expiry))",
+		},
+		{
+			[]StoreOption{WithDeletedAtColumnName("deleted_at")},
+			"UPDATE sessions SET expiry = $2 WHERE token = $1 AND data = $3 AND deleted_at IS NULL",
+		},
+	}
+	for _, test := range tests {
+		query, args := newQueryTestStore(t, test.opts...).touchUnchangedQuery("session_token", []byte("encoded_data"), time.Now())
+		if query != test.expected {
+			t.Fatalf("got %q: expected %q", query, test.expected)
+		}
+		if len(args) != 3 {
+			t.Fatalf("got %d args: expected %d", len(args), 3)
+		}
+	}
+}
+
+func TestQueryArgs(t *testing.T) {
+	args := &queryArgs{dialect: PostgresDialect{}}
+	placeholders := []string{args.add("a"), args.add(2), args.add(nil)}
+	if reflect.DeepEqual(placeholders, []string{"$1", "$2", "$3"}) == false {
+		t.Fatalf("got %v: expected %v", placeholders, []string{"$1", "$2", "$3"})
+	}
+	if reflect.DeepEqual(args.values, []interface{}{"a", 2, nil}) == false {
+		t.Fatalf("got %v: expected %v", args.values, []interface{}{"a", 2, nil})
+	}
+
+	args = &queryArgs{dialect: MySQLDialect{}}
+	if placeholder := args.add("a"); placeholder != "?" {
+		t.Fatalf("got %q: expected %q", placeholder, "?")
+	}
+}
+
+func TestCommitQueryExpiryUTC(t *testing.T) {
+	loc := time.FixedZone("UTC+5", 5*60*60)
+	expiry := time.Date(2030, 1, 2, 15, 4, 5, 0, loc)
+
+	_, args := newQueryTestStore(t).commitQuery("session_token", []byte("encoded_data"), expiry)
+	got, ok := args[2].(time.Time)
+	if !ok {
+		t.Fatalf("got %T: expected time.Time", args[2])
+	}
+	if got.Location() != time.UTC || !got.Equal(expiry) {
+		t.Fatalf("got %v: expected %v", got, expiry.UTC())
+	}
+
+	_, args = newQueryTestStore(t).commitQuery("session_token", []byte("encoded_data"), time.Time{})
+	if args[2] != nil {
+		t.Fatalf("got %v: expected %v", args[2], nil)
+	}
+}
+
+func TestDeleteQuery(t *testing.T) {
+	tests := []struct {
+		opts     []StoreOption
+		expected string
+	}{
+		{
+			nil,
+			"DELETE FROM sessions WHERE token = $1",
+		},
+		{
+			[]StoreOption{WithDialect(SQLiteDialect{})},
+			"DELETE FROM sessions WHERE token = ?",
+		},
+		{
+			[]StoreOption{WithLargeObjectData()},
+			"WITH d AS (DELETE FROM sessions WHERE token = $1 RETURNING data) SELECT lo_unlink(data) FROM d",
+		},
+		{
+			[]StoreOption{WithType("web"), WithTypeColumnName("kind")},
+			"DELETE FROM sessions WHERE token = $1 AND kind = 'web'",
+		},
+		{
+			[]StoreOption{WithDeletedAtColumnName("deleted_at"), WithLargeObjectData()},
+			"UPDATE sessions SET deleted_at = current_timestamp WHERE token = $1 AND deleted_at IS NULL",
+		},
+		{
+			[]StoreOption{WithDeletedAtColumnName("deleted_at"), WithNowFunc(func() time.Time { return time.Unix(0, 0) })},
+			"UPDATE sessions SET deleted_at = current_timestamp WHERE token = $1 AND deleted_at IS NULL",
+		},
+	}
+	for _, test := range tests {
+		query := newQueryTestStore(t, test.opts...).deleteQuery()
+		if query != test.expected {
+			t.Fatalf("got %q: expected %q", query, test.expected)
+		}
+	}
+}
+
+func TestDeleteExpiredQuery(t *testing.T) {
+	tests := []struct {
+		opts      []StoreOption
+		limit     int
+		returning bool
+		expected  string
+	}{
+		{
+			nil, 0, false,
+			"DELETE FROM sessions WHERE expiry IS NOT NULL AND expiry < current_timestamp",
+		},
+		{
+			nil, 100, true,
+			"DELETE FROM sessions WHERE token IN (SELECT token FROM sessions WHERE expiry IS NOT NULL AND expiry < current_timestamp LIMIT 100) RETURNING token, expiry",
+		},
+		{
+			[]StoreOption{WithCleanupStrategy(CleanupSkipLocked)}, 0, false,
+			"DELETE FROM sessions WHERE token IN (SELECT token FROM sessions WHERE expiry IS NOT NULL AND expiry < current_timestamp FOR UPDATE SKIP LOCKED)",
+		},
+		{
+			[]StoreOption{WithCleanupStrategy(CleanupSkipLocked)}, 100, true,
+			"DELETE FROM sessions WHERE token IN (SELECT token FROM sessions WHERE expiry IS NOT NULL AND expiry < current_timestamp LIMIT 100 FOR UPDATE SKIP LOCKED) RETURNING token, expiry",
+		},
+		{
+			[]StoreOption{WithCleanupPartitionFilter(func(now string) string { return "created_at < " + now + " - interval '1 day'" })}, 0, false,
+			"DELETE FROM sessions WHERE (expiry IS NOT NULL AND expiry < current_timestamp) AND (created_at < current_timestamp - interval '1 day')",
+		},
+		{
+			[]StoreOption{WithType("web"), WithActivePredicate(func(now string) string { return "expiry > " + now })}, 0, false,
+			"DELETE FROM sessions WHERE NOT (expiry > current_timestamp) AND type = 'web'",
+		},
+		{
+			[]StoreOption{WithExpiryGraceWindow(time.Minute)}, 0, false,
+			"DELETE FROM sessions WHERE expiry IS NOT NULL AND expiry < (current_timestamp - interval '60000000 microseconds')",
+		},
+		{
+			[]StoreOption{WithLargeObjectData()}, 0, true,
+			"WITH d AS (DELETE FROM sessions WHERE expiry IS NOT NULL AND expiry < current_timestamp RETURNING token, expiry, data) SELECT token, expiry FROM d WHERE (data IS NULL OR lo_unlink(data) = 1)",
+		},
+	}
+	for _, test := range tests {
+		query, args := newQueryTestStore(t, test.opts...).deleteExpiredQuery(test.limit, test.returning)
+		if query != test.expected {
+			t.Fatalf("got %q: expected %q", query, test.expected)
+		}
+		if len(args) != 0 {
+			t.Fatalf("got %v: expected no args", args)
+		}
+	}
+
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	query, args := newQueryTestStore(t, WithNowFunc(func() time.Time { return now })).deleteExpiredQuery(0, false)
+	expected := "DELETE FROM sessions WHERE expiry IS NOT NULL AND expiry < $1"
+	if query != expected {
+		t.Fatalf("got %q: expected %q", query, expected)
+	}
+	if reflect.DeepEqual(args, []interface{}{now}) == false {
+		t.Fatalf("got %v: expected %v", args, []interface{}{now})
+	}
+}
+
+func TestNowFuncFindQuery(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	query := newQueryTestStore(t, WithNowFunc(func() time.Time { return now })).findQuery()
+	expected := "SELECT data, expiry FROM sessions WHERE token = $1 AND (expiry IS NULL OR '2020-01-02T03:04:05Z'::timestamptz < expiry)"
+	if query != expected {
+		t.Fatalf("got %q: expected %q", query, expected)
+	}
+}
+
+func BenchmarkFindQuery(b *testing.B) {
+	p := newQueryTestStore(b, WithAbsoluteExpiry("absolute_expiry", time.Hour))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		p.findQuery()
+	}
+}
+
+func BenchmarkCommitQuery(b *testing.B) {
+	p := newQueryTestStore(b, WithUpdatedAtColumnName("updated_at"), WithVersionColumnName("version"))
+	data := []byte("encoded_data")
+	expiry := time.Now().Add(time.Minute)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		p.commitQuery("session_token", data, expiry)
+	}
+}
+
+func TestQuotedIdentifierQueries(t *testing.T) {
+	p := newQueryTestStore(t,
+		WithQuotedIdentifiers(),
+		WithSessionTableName("auth.webSessions"),
+		WithTokenColumnName("sessionToken"),
+		WithUpdatedAtColumnName("updatedAt"),
+	)
+
+	query := p.findQuery()
+	expected := `SELECT "data", "expiry" FROM "auth"."webSessions" WHERE "sessionToken" = $1 AND ("expiry" IS NULL OR current_timestamp < "expiry")`
+	if query != expected {
+		t.Fatalf("got %q: expected %q", query, expected)
+	}
+
+	query, _ = p.commitQuery("session_token", []byte("encoded_data"), time.Now())
+	expected = `INSERT INTO "auth"."webSessions" ("sessionToken", "data", "expiry", "updatedAt") VALUES ($1, $2, $3, clock_timestamp()) ON CONFLICT ("sessionToken") DO UPDATE SET "data" = EXCLUDED."data", "expiry" = EXCLUDED."expiry", "updatedAt" = EXCLUDED."updatedAt"`
+	if query != expected {
+		t.Fatalf("got %q: expected %q", query, expected)
+	}
+}
@@ -0,0 +1,56 @@
+package postgresstore
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// findGroup collapses concurrent finds of the same token into one query, for
+// stores created with the WithSingleFlight option.
+type findGroup struct {
+	mu    sync.Mutex
+	calls map[string]*findCall
+}
+
+// findCall is a find which is in progress. Its result is set before done is
+// closed.
+type findCall struct {
+	done   chan struct{}
+	b      []byte
+	expiry time.Time
+	exists bool
+	err    error
+}
+
+func newFindGroup() *findGroup {
+	return &findGroup{calls: make(map[string]*findCall)}
+}
+
+// do calls fn and returns its result, unless a call for the same token is
+// already in progress, in which case it waits for that call and returns its
+// result instead. If ctx is cancelled while waiting, ctx.Err() is returned.
+func (g *findGroup) do(ctx context.Context, token string, fn func() ([]byte, time.Time, bool, error)) ([]byte, time.Time, bool, error) {
+	g.mu.Lock()
+	if c, ok := g.calls[token]; ok {
+		g.mu.Unlock()
+		select {
+		case <-c.done:
+			return c.b, c.expiry, c.exists, c.err
+		case <-ctx.Done():
+			return nil, time.Time{}, false, classifyError(ctx.Err())
+		}
+	}
+	c := &findCall{done: make(chan struct{})}
+	g.calls[token] = c
+	g.mu.Unlock()
+
+	c.b, c.expiry, c.exists, c.err = fn()
+
+	g.mu.Lock()
+	delete(g.calls, token)
+	g.mu.Unlock()
+	close(c.done)
+
+	return c.b, c.expiry, c.exists, c.err
+}
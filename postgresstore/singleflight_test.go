@@ -0,0 +1,152 @@
+package postgresstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFindGroup(t *testing.T) {
+	g := newFindGroup()
+	expiry := time.Now().Add(time.Minute)
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	var (
+		mu    sync.Mutex
+		calls int
+	)
+	fn := func() ([]byte, time.Time, bool, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		close(started)
+		<-release
+		return []byte("encoded_data"), expiry, true, nil
+	}
+
+	type result struct {
+		b      []byte
+		expiry time.Time
+		exists bool
+		err    error
+	}
+	results := make(chan result, 5)
+	go func() {
+		b, e, exists, err := g.do(context.Background(), "session_token", fn)
+		results <- result{b, e, exists, err}
+	}()
+	<-started
+	for i := 0; i < 4; i++ {
+		go func() {
+			b, e, exists, err := g.do(context.Background(), "session_token", fn)
+			results <- result{b, e, exists, err}
+		}()
+	}
+
+	// The waiting calls can't be observed directly, so give them time to
+	// join the call in progress before it is released.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	for i := 0; i < 5; i++ {
+		r := <-results
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		if r.exists != true || !r.expiry.Equal(expiry) || reflect.DeepEqual(r.b, []byte("encoded_data")) == false {
+			t.Fatalf("got %v: expected the shared result", r)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("got %d: expected %d", calls, 1)
+	}
+
+	// Once a call has finished, the next one runs a new query.
+	errFind := errors.New("find failed")
+	_, _, exists, err := g.do(context.Background(), "session_token", func() ([]byte, time.Time, bool, error) {
+		return nil, time.Time{}, false, errFind
+	})
+	if err != errFind || exists != false {
+		t.Fatalf("got %v, %v: expected %v, %v", exists, err, false, errFind)
+	}
+}
+
+func TestFindGroupCancel(t *testing.T) {
+	g := newFindGroup()
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+
+	go g.do(context.Background(), "session_token", func() ([]byte, time.Time, bool, error) {
+		close(started)
+		<-release
+		return nil, time.Time{}, false, nil
+	})
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, _, _, err := g.do(ctx, "session_token", func() ([]byte, time.Time, bool, error) {
+		t.Fatal("expected the call in progress to be joined")
+		return nil, time.Time{}, false, nil
+	})
+	if errors.Is(err, ErrCanceled) == false {
+		t.Fatalf("got %v: expected %v", err, ErrCanceled)
+	}
+}
+
+func TestSingleFlight(t *testing.T) {
+	dsn := os.Getenv("SCS_POSTGRES_TEST_DSN")
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("TRUNCATE TABLE sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO sessions VALUES('session_token', 'encoded_data', current_timestamp + interval '1 minute')")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := New(db, WithCleanupInterval(0), WithSingleFlight())
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b, found, err := p.Find("session_token")
+			if err != nil {
+				errs <- err
+			} else if found != true || reflect.DeepEqual(b, []byte("encoded_data")) == false {
+				errs <- errors.New("session not found")
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	_, found, err := p.Find("missing_session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+}
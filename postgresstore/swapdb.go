@@ -0,0 +1,58 @@
+package postgresstore
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// dbHandle holds the database handle of a store. It is shared by the store,
+// its cleanup goroutine, its write-behind flusher and its views, so that a
+// handle replaced by SwapDB is seen by all of them.
+type dbHandle struct {
+	mu sync.RWMutex
+	db *sql.DB
+}
+
+func (h *dbHandle) get() *sql.DB {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.db
+}
+
+func (h *dbHandle) set(db *sql.DB) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.db = db
+}
+
+func (h *dbHandle) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return h.get().ExecContext(ctx, query, args...)
+}
+
+func (h *dbHandle) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return h.get().QueryContext(ctx, query, args...)
+}
+
+func (h *dbHandle) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return h.get().QueryRowContext(ctx, query, args...)
+}
+
+// SwapDB replaces the database handle used by the store, including by its
+// cleanup goroutine, so that a process can move to a fresh *sql.DB, for
+// example after a long outage has left every connection in the old pool
+// stale, without recreating the store. Operations which have already started
+// finish on the old handle, and those started afterwards use db. SwapDB doesn't
+// close the old handle; close it yourself once the operations using it have
+// finished. The handle given to WithCleanupDB, if any, is not replaced.
+// Views returned by BindConn keep running on their pinned connection.
+func (p *PostgresStore) SwapDB(db *sql.DB) error {
+	if err := p.checkDB(); err != nil {
+		return err
+	}
+	if db == nil {
+		return ErrNilDB
+	}
+	p.db.set(db)
+	return nil
+}
@@ -0,0 +1,64 @@
+package postgresstore
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSwapDB(t *testing.T) {
+	dsn := os.Getenv("SCS_POSTGRES_TEST_DSN")
+	oldDB, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("TRUNCATE TABLE sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := New(oldDB, WithCleanupInterval(0))
+	err = p.Commit("session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the old handle has been swapped out, closing it doesn't affect the
+	// store.
+	err = p.SwapDB(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldDB.Close()
+
+	b, found, err := p.Find("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != true || reflect.DeepEqual(b, []byte("encoded_data")) == false {
+		t.Fatalf("got %v, %v: expected %v, %v", found, b, true, []byte("encoded_data"))
+	}
+	report, err := p.Health(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Reachable != true {
+		t.Fatalf("got %v: expected %v", report.Reachable, true)
+	}
+
+	err = p.SwapDB(nil)
+	if err != ErrNilDB {
+		t.Fatalf("got %v: expected %v", err, ErrNilDB)
+	}
+}
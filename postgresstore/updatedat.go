@@ -0,0 +1,45 @@
+package postgresstore
+
+import "context"
+
+// UpdatedAtMode controls whether a single write sets the updated-at column of
+// a store created with the WithUpdatedAtColumnName option. It is attached to
+// the context passed to CommitCtx, CommitWithResult or ReplaceCtx with
+// WithUpdatedAt.
+type UpdatedAtMode int
+
+// The modes which can be passed to WithUpdatedAt.
+const (
+	// UpdatedAtDefault sets the updated-at column as configured for the
+	// store: on every write, or only when the data changes if the store was
+	// created with the WithUpdatedAtOnChange option.
+	UpdatedAtDefault UpdatedAtMode = iota
+
+	// UpdatedAtForce sets the updated-at column whether or not the data
+	// changes, even if the store was created with the WithUpdatedAtOnChange
+	// or WithExpiryOnlyUpdates option.
+	UpdatedAtForce
+
+	// UpdatedAtSuppress leaves the updated-at column of an existing session
+	// unchanged. It is still set when a session is created.
+	UpdatedAtSuppress
+)
+
+type updatedAtKey struct{}
+
+// WithUpdatedAt returns a copy of ctx which makes the writes it's passed to
+// set the updated-at column according to mode, rather than as configured for
+// the store. For example, a keep-alive commit which is known to only extend the
+// expiry can use UpdatedAtSuppress, so that it doesn't show up in ChangedSince.
+// Commits with a mode other than UpdatedAtDefault are written directly, rather
+// than buffered, by stores created with the WithWriteBehind option.
+func WithUpdatedAt(ctx context.Context, mode UpdatedAtMode) context.Context {
+	return context.WithValue(ctx, updatedAtKey{}, mode)
+}
+
+// updatedAtMode returns the mode attached to ctx with WithUpdatedAt, or
+// UpdatedAtDefault.
+func updatedAtMode(ctx context.Context) UpdatedAtMode {
+	mode, _ := ctx.Value(updatedAtKey{}).(UpdatedAtMode)
+	return mode
+}
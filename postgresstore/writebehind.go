@@ -0,0 +1,327 @@
+package postgresstore
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// writeBuffer holds the sessions committed to a store created with the
+// WithWriteBehind option which haven't been written to the database yet.
+type writeBuffer struct {
+	mu       sync.Mutex
+	pending  map[string]pendingWrite // Keyed by token.
+	order    []string                // The tokens in pending, in the order they were first committed.
+	inflight map[string]pendingWrite // The batch being written by the current flush.
+	closed   bool
+	paused   bool // Set while the store is in drain mode, to stop the flusher.
+
+	maxBatch int
+	full     chan struct{} // Signalled when maxBatch sessions are pending.
+	stop     chan struct{}
+	done     chan struct{} // Closed when the flusher goroutine returns.
+	stopOnce sync.Once
+
+	// flushMu is held for the whole of each flush, so that batches are written
+	// in order and a Delete can wait for a write of the same token to finish.
+	flushMu sync.Mutex
+}
+
+type pendingWrite struct {
+	token  string
+	data   []byte
+	expiry time.Time
+
+	// updatedAt is only set for writes which aren't buffered.
+	updatedAt UpdatedAtMode
+}
+
+func newWriteBuffer(maxBatch int) *writeBuffer {
+	return &writeBuffer{
+		pending:  make(map[string]pendingWrite),
+		inflight: make(map[string]pendingWrite),
+		maxBatch: maxBatch,
+		full:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// add buffers a commit, replacing any pending commit of the same token. It
+// returns false if the buffer has been closed, in which case the commit should
+// be written directly.
+func (w *writeBuffer) add(token string, b []byte, expiry time.Time) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return false
+	}
+	if _, ok := w.pending[token]; !ok {
+		w.order = append(w.order, token)
+	}
+	w.pending[token] = pendingWrite{token: token, data: b, expiry: expiry}
+	if len(w.order) >= w.maxBatch {
+		select {
+		case w.full <- struct{}{}:
+		default:
+		}
+	}
+	return true
+}
+
+// get returns the buffered data and expiry time for a token, including a
+// token which is being written by a flush that hasn't finished.
+func (w *writeBuffer) get(token string) (b []byte, expiry time.Time, ok bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	pw, ok := w.pending[token]
+	if !ok {
+		pw, ok = w.inflight[token]
+	}
+	return pw.data, pw.expiry, ok
+}
+
+// discard removes any buffered commit of a token. If the token is being
+// written by a flush, it waits for the flush to finish, so that a delete which
+// follows isn't overtaken by the write.
+func (w *writeBuffer) discard(token string) {
+	w.pop(token)
+}
+
+// pop is the same as discard, except that it returns the commit which was
+// removed, if there was one.
+func (w *writeBuffer) pop(token string) (pendingWrite, bool) {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	pw, ok := w.pending[token]
+	if !ok {
+		return pendingWrite{}, false
+	}
+	delete(w.pending, token)
+	for i, t := range w.order {
+		if t == token {
+			w.order = append(w.order[:i], w.order[i+1:]...)
+			break
+		}
+	}
+	return pw, true
+}
+
+// restore puts back a commit removed with pop whose write failed, unless the
+// token has been committed again since. It returns false if the buffer has
+// been closed, in which case the commit should be written directly.
+func (w *writeBuffer) restore(pw pendingWrite) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return false
+	}
+	if _, ok := w.pending[pw.token]; ok {
+		return true
+	}
+	if _, ok := w.inflight[pw.token]; ok {
+		return true
+	}
+	w.order = append(w.order, pw.token)
+	w.pending[pw.token] = pw
+	return true
+}
+
+// take moves up to maxBatch of the oldest pending commits to the in-flight
+// batch and returns them.
+func (w *writeBuffer) take() []pendingWrite {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	n := len(w.order)
+	if n > w.maxBatch {
+		n = w.maxBatch
+	}
+	batch := make([]pendingWrite, n)
+	for i, token := range w.order[:n] {
+		batch[i] = w.pending[token]
+		w.inflight[token] = batch[i]
+		delete(w.pending, token)
+	}
+	w.order = append([]string(nil), w.order[n:]...)
+	return batch
+}
+
+func (w *writeBuffer) clearInflight() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.inflight = make(map[string]pendingWrite)
+}
+
+// flush writes all of the pending commits to the database using p, in
+// batches of at most maxBatch. It stops at the first batch which fails.
+func (w *writeBuffer) flush(ctx context.Context, p *PostgresStore) error {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+
+	for {
+		batch := w.take()
+		if len(batch) == 0 {
+			return nil
+		}
+		err := p.writeBatch(ctx, batch)
+		w.clearInflight()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// run flushes the buffer every interval, or when it fills up, until the buffer
+// is stopped.
+func (w *writeBuffer) run(p *PostgresStore, interval time.Duration) {
+	defer close(w.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.full:
+		case <-w.stop:
+			return
+		}
+		if w.isPaused() {
+			continue
+		}
+		if err := w.flush(context.Background(), p); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// pause stops or restarts the flusher goroutine's writes. Commits are still
+// buffered while it is paused, and flush still writes them.
+func (w *writeBuffer) pause(paused bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.paused = paused
+}
+
+func (w *writeBuffer) isPaused() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.paused
+}
+
+// close stops the flusher goroutine and waits for it to return. Commits made
+// after close are not buffered.
+func (w *writeBuffer) close() {
+	w.mu.Lock()
+	w.closed = true
+	w.mu.Unlock()
+
+	w.stopOnce.Do(func() { close(w.stop) })
+	<-w.done
+}
+
+// collectingSink is an EventSink which holds on to the events published to it,
+// so that they can be forwarded once a transaction has been committed.
+type collectingSink struct {
+	events []SessionEvent
+}
+
+func (s *collectingSink) Publish(event SessionEvent) {
+	s.events = append(s.events, event)
+}
+
+// writeBatch writes a batch of buffered commits in a single transaction, using
+// one upsert per commitManyBatch sessions. Stores created with the
+// WithLargeObjectData or WithExpiryOnlyUpdates options write each session with
+// its own statements instead, as Commit does. Events for the batch are
+// published once the transaction has been committed.
+func (p *PostgresStore) writeBatch(ctx context.Context, batch []pendingWrite) error {
+	tx, err := p.beginTx(ctx, nil)
+	if err != nil {
+		return classifyError(err)
+	}
+	defer tx.Rollback()
+
+	view := p.withQueryer(tx)
+	var sink *collectingSink
+	if p.opts.eventSink != nil {
+		sink = &collectingSink{}
+		view.opts.eventSink = sink
+	}
+	if p.opts.largeObjectData || p.opts.expiryOnlyUpdates {
+		for _, pw := range batch {
+			_, err = view.commit(ctx, pw.token, pw.data, pw.expiry)
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		for start := 0; start < len(batch); start += commitManyBatch {
+			end := start + commitManyBatch
+			if end > len(batch) {
+				end = len(batch)
+			}
+			err = view.writeRows(ctx, batch[start:end], nil)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return classifyError(err)
+	}
+
+	if sink != nil {
+		for _, event := range sink.events {
+			p.opts.eventSink.Publish(event)
+		}
+	}
+	return nil
+}
+
+// Flush writes the sessions buffered by the WithWriteBehind option to the
+// database, returning once they have all been written or one of the batches
+// has failed. The sessions in a failed batch are discarded. If the store
+// wasn't created with WithWriteBehind, Flush does nothing.
+func (p *PostgresStore) Flush(ctx context.Context) error {
+	if err := p.checkDB(); err != nil {
+		return err
+	}
+	if p.writes == nil {
+		return nil
+	}
+	return p.writes.flush(ctx, p)
+}
+
+// flushWrites writes any sessions buffered by the WithWriteBehind option, so
+// that a bulk delete which follows can't be undone by a later flush.
+func (p *PostgresStore) flushWrites() error {
+	if p.writes == nil {
+		return nil
+	}
+	return p.writes.flush(context.Background(), p)
+}
+
+// Close stops the store's background goroutines and, if the store was created
+// with the WithWriteBehind option, writes any buffered sessions to the
+// database. Commits made after Close are written directly. It is safe to call
+// Close more than once.
+func (p *PostgresStore) Close() error {
+	if err := p.checkDB(); err != nil {
+		return err
+	}
+	p.StopCleanup()
+	if p.writes == nil {
+		return nil
+	}
+	p.writes.close()
+	return p.writes.flush(context.Background(), p)
+}
@@ -0,0 +1,504 @@
+package postgresstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWriteBehind(t *testing.T) {
+	dsn := os.Getenv("SCS_POSTGRES_TEST_DSN")
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("TRUNCATE TABLE sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := New(db, WithCleanupInterval(0), WithWriteBehind(time.Hour, 100))
+	defer p.Close()
+
+	err = p.Commit("session_token_1", []byte("encoded_data_1"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Commit("session_token_1", []byte("new_encoded_data_1"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Commit("session_token_2", []byte("encoded_data_2"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The writes are buffered, but visible to Find.
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatalf("got %d: expected %d", count, 0)
+	}
+	b, found, err := p.Find("session_token_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+	if reflect.DeepEqual(b, []byte("new_encoded_data_1")) == false {
+		t.Fatalf("got %v: expected %v", b, []byte("new_encoded_data_1"))
+	}
+
+	err = p.Delete("session_token_2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.Flush(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := New(db, WithCleanupInterval(0)).All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]byte{"session_token_1": []byte("new_encoded_data_1")}
+	if reflect.DeepEqual(sessions, expected) == false {
+		t.Fatalf("got %v: expected %v", sessions, expected)
+	}
+}
+
+func TestWriteBehindBatch(t *testing.T) {
+	dsn := os.Getenv("SCS_POSTGRES_TEST_DSN")
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("TRUNCATE TABLE sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := New(db, WithCleanupInterval(0), WithWriteBehind(time.Hour, 2))
+
+	err = p.Commit("session_token_1", []byte("encoded_data_1"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Commit("session_token_2", []byte("encoded_data_2"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A full batch is flushed without waiting for the interval.
+	var count int
+	for i := 0; i < 50; i++ {
+		err = db.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count == 2 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if count != 2 {
+		t.Fatalf("got %d: expected %d", count, 2)
+	}
+
+	err = p.Commit("session_token_3", []byte("encoded_data_3"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Fatalf("got %d: expected %d", count, 3)
+	}
+
+	// Commits made after Close are written directly.
+	err = p.Commit("session_token_4", []byte("encoded_data_4"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Fatalf("got %d: expected %d", count, 4)
+	}
+}
+
+func TestWriteBehindLargeBatch(t *testing.T) {
+	dsn := os.Getenv("SCS_POSTGRES_TEST_DSN")
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("TRUNCATE TABLE sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A batch larger than one statement can hold is split across several.
+	p := New(db, WithCleanupInterval(0), WithWriteBehind(time.Hour, 2*commitManyBatch+1))
+	defer p.Close()
+	for i := 0; i < 2*commitManyBatch+1; i++ {
+		err = p.Commit(fmt.Sprintf("session_token_%d", i), []byte("encoded_data"), time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = p.Flush(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2*commitManyBatch+1 {
+		t.Fatalf("got %d: expected %d", count, 2*commitManyBatch+1)
+	}
+}
+
+func TestWriteBehindOptions(t *testing.T) {
+	db, err := sql.Open("postgres", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, opt := range []StoreOption{
+		WithWriteBehind(0, 100),
+		WithWriteBehind(time.Second, 0),
+		WithWriteBehind(-time.Second, 100),
+	} {
+		_, err = NewStore(db, WithCleanupInterval(0), opt)
+		if err == nil {
+			t.Fatalf("got %v: expected an error", err)
+		}
+	}
+
+	p, err := NewStore(db, WithCleanupInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Flush(context.Background())
+	if err != nil {
+		t.Fatalf("got %v: expected %v", err, nil)
+	}
+	err = p.Close()
+	if err != nil {
+		t.Fatalf("got %v: expected %v", err, nil)
+	}
+}
+
+func TestWriteBehindRotateToken(t *testing.T) {
+	dsn := os.Getenv("SCS_POSTGRES_TEST_DSN")
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("TRUNCATE TABLE sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO sessions VALUES('session_token', 'encoded_data', current_timestamp + interval '1 minute')")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := New(db, WithCleanupInterval(0), WithWriteBehind(time.Hour, 100))
+	defer p.Close()
+
+	err = p.Commit("session_token", []byte("new_encoded_data"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists, err := p.RotateToken("session_token", "new_session_token", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists != true {
+		t.Fatalf("got %v: expected %v", exists, true)
+	}
+
+	// The buffered data moves to the new token, and the old token isn't
+	// recreated by a later flush.
+	err = p.Flush(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, err := p.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]byte{"new_session_token": []byte("new_encoded_data")}
+	if reflect.DeepEqual(sessions, expected) == false {
+		t.Fatalf("got %v: expected %v", sessions, expected)
+	}
+}
+
+func TestWriteBehindRotateTokenFailure(t *testing.T) {
+	dsn := os.Getenv("SCS_POSTGRES_TEST_DSN")
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	table := newTestTable(t, "token TEXT PRIMARY KEY, data BYTEA NOT NULL, expiry TIMESTAMPTZ NOT NULL")
+	_, err = db.Exec(fmt.Sprintf(`INSERT INTO %s (token, data, expiry) VALUES
+		('session_token_1', 'encoded_data_1', current_timestamp + interval '1 minute'),
+		('session_token_2', 'encoded_data_2', current_timestamp + interval '1 minute')`, table))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The rotation runs in a transaction, so the write of the buffered commit
+	// is rolled back with it.
+	p := New(db, WithCleanupInterval(0), WithSessionTableName(table), WithWriteBehind(time.Hour, 100), WithIsolationLevel(sql.LevelSerializable, 0))
+	defer p.Close()
+
+	err = p.Commit("session_token_1", []byte("new_encoded_data_1"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.RotateToken("session_token_1", "session_token_2", time.Now().Add(time.Hour))
+	if err == nil {
+		t.Fatalf("got %v: expected an error", err)
+	}
+
+	// The buffered commit isn't lost when the rotation fails.
+	err = p.Flush(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	err = db.QueryRow(fmt.Sprintf("SELECT data FROM %s WHERE token = 'session_token_1'", table)).Scan(&data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(data, []byte("new_encoded_data_1")) == false {
+		t.Fatalf("got %q: expected %q", data, "new_encoded_data_1")
+	}
+}
+
+func TestWriteBehindDrain(t *testing.T) {
+	dsn := os.Getenv("SCS_POSTGRES_TEST_DSN")
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("TRUNCATE TABLE sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := New(db, WithCleanupInterval(0), WithWriteBehind(time.Hour, 100))
+	defer p.Close()
+
+	err = p.Commit("session_token_1", []byte("encoded_data_1"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Drain writes the buffered sessions before returning.
+	p.Drain()
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("got %d: expected %d", count, 1)
+	}
+	if p.writes.isPaused() != true {
+		t.Fatalf("got %v: expected %v", p.writes.isPaused(), true)
+	}
+
+	p.Undrain()
+	if p.writes.isPaused() != false {
+		t.Fatalf("got %v: expected %v", p.writes.isPaused(), false)
+	}
+}
+
+func TestWriteBehindDeleteOtherSessions(t *testing.T) {
+	dsn := os.Getenv("SCS_POSTGRES_TEST_DSN")
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	table := newTestTable(t, "token TEXT PRIMARY KEY, data BYTEA NOT NULL, expiry TIMESTAMPTZ NOT NULL, subject TEXT")
+
+	p := New(db, WithCleanupInterval(0), WithSessionTableName(table), WithWriteBehind(time.Hour, 100), WithSubjectColumn("subject", func(token string, data []byte) string {
+		return string(data)
+	}))
+	defer p.Close()
+
+	err = p.Commit("session_token_1", []byte("alice"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Commit("session_token_2", []byte("alice"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The buffered session is deleted, and isn't recreated by a later flush.
+	n, err := p.DeleteOtherSessions("alice", "session_token_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("got %d: expected %d", n, 1)
+	}
+	err = p.Flush(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, found, err := p.Find("session_token_2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+}
+
+func TestWriteBehindDeleteRange(t *testing.T) {
+	dsn := os.Getenv("SCS_POSTGRES_TEST_DSN")
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("TRUNCATE TABLE sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := New(db, WithCleanupInterval(0), WithWriteBehind(time.Hour, 100))
+	defer p.Close()
+
+	err = p.Commit("session_token_1", []byte("encoded_data_1"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The buffered session is deleted, and isn't recreated by a later flush.
+	n, err := p.DeleteRange("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("got %d: expected %d", n, 1)
+	}
+	err = p.Flush(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, found, err := p.Find("session_token_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+}
+
+func TestWriteBehindUpdatedAtMode(t *testing.T) {
+	dsn := os.Getenv("SCS_POSTGRES_TEST_DSN")
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	table := newTestTable(t, "token TEXT PRIMARY KEY, data BYTEA NOT NULL, expiry TIMESTAMPTZ NOT NULL, updated_at TIMESTAMPTZ")
+
+	p := New(db, WithCleanupInterval(0), WithSessionTableName(table), WithUpdatedAtColumnName("updated_at"), WithWriteBehind(time.Hour, 100))
+	defer p.Close()
+
+	err = p.Commit("session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A commit with an updated-at mode is written directly, and the buffered
+	// write isn't written over it by a later flush.
+	ctx := WithUpdatedAt(context.Background(), UpdatedAtForce)
+	err = p.CommitCtx(ctx, "session_token", []byte("new_encoded_data"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	err = db.QueryRow(fmt.Sprintf("SELECT data FROM %s WHERE token = 'session_token'", table)).Scan(&data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(data, []byte("new_encoded_data")) {
+		t.Fatalf("got %q: expected %q", data, "new_encoded_data")
+	}
+	err = p.Flush(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _, err := p.Find("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(b, []byte("new_encoded_data")) {
+		t.Fatalf("got %q: expected %q", b, "new_encoded_data")
+	}
+}